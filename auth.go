@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Authentication modes for scorekeeper requests
+const (
+	authModeAuto   = "auto"   // sign requests, fall back to bearer if the scorekeeper cannot verify them
+	authModeHMAC   = "hmac"   // always sign requests
+	authModeBearer = "bearer" // always send the key as a bearer token
+)
+
+// hmacScheme names the request signing scheme in Authorization headers and
+// in the scorekeeper's WWW-Authenticate challenge
+const hmacScheme = "Tally-HMAC-SHA256"
+
+// Headers carrying the signed request parameters
+const (
+	requestTimestampHeader = "X-Tally-Timestamp"
+	requestNonceHeader     = "X-Tally-Nonce"
+	requestContentHeader   = "X-Tally-Content-SHA256"
+)
+
+// bearerFallbackPeriod is how long a beacon in auto mode sends bearer auth
+// after the scorekeeper failed to verify a signed request, before it tries
+// signing again
+const bearerFallbackPeriod = 15 * time.Minute
+
+// bearerFallbackUntil is the time (Unix nanoseconds) until which requests in
+// auto mode use bearer auth
+var bearerFallbackUntil atomic.Int64
+
+// signedRequestAccepted is set once the scorekeeper has accepted a signed
+// request. It then evidently supports signing, so a later 401 no longer
+// makes auto mode fall back to bearer auth.
+var signedRequestAccepted atomic.Bool
+
+// useHMAC reports whether requests are currently signed
+func useHMAC() bool {
+	switch cfg.AuthMode {
+	case authModeHMAC:
+		return true
+	case authModeBearer:
+		return false
+	}
+	return time.Now().UnixNano() >= bearerFallbackUntil.Load()
+}
+
+// fallBackToBearer switches auto mode to bearer auth for bearerFallbackPeriod
+func fallBackToBearer() {
+	bearerFallbackUntil.Store(time.Now().Add(bearerFallbackPeriod).UnixNano())
+	logger.Error("Scorekeeper did not accept a signed request, falling back to bearer authentication",
+		"retry_signing_in", bearerFallbackPeriod)
+}
+
+// cancelBearerFallback returns auto mode to signed requests
+func cancelBearerFallback() {
+	bearerFallbackUntil.Store(0)
+}
+
+// hmacSigningKey derives the request signing key from the beacon key, so
+// that the key itself never appears in a request
+func hmacSigningKey(key string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte("tally-request-signing-v1"))
+	return mac.Sum(nil)
+}
+
+// signRequest adds the signature headers to req. The signature covers
+//
+//	Tally-HMAC-SHA256\n<METHOD>\n<request URI>\n<timestamp>\n<nonce>\n<hex SHA-256 of body>
+//
+// and is sent as: Authorization: Tally-HMAC-SHA256 beacon="<id>", signature="<base64>"
+func signRequest(req *http.Request, body []byte, key string) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	bodyHash := sha256.Sum256(body)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonceHex := hex.EncodeToString(nonce)
+	contentHash := hex.EncodeToString(bodyHash[:])
+
+	canonical := strings.Join([]string{
+		hmacScheme,
+		req.Method,
+		req.URL.RequestURI(),
+		timestamp,
+		nonceHex,
+		contentHash,
+	}, "\n")
+
+	mac := hmac.New(sha256.New, hmacSigningKey(key))
+	mac.Write([]byte(canonical))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	req.Header.Set(requestTimestampHeader, timestamp)
+	req.Header.Set(requestNonceHeader, nonceHex)
+	req.Header.Set(requestContentHeader, contentHash)
+	req.Header.Set("Authorization", fmt.Sprintf("%s beacon=%q, signature=%q", hmacScheme, cfg.BeaconID, signature))
+	return nil
+}
+
+// authorizeRequest authenticates req with the beacon key using the current
+// authentication mode, and reports whether it signed the request
+func authorizeRequest(req *http.Request, body []byte, key string) (bool, error) {
+	if useHMAC() {
+		return true, signRequest(req, body, key)
+	}
+	req.Header.Set("Authorization", "Bearer "+key)
+	return false, nil
+}
+
+// shouldFallBackToBearer reports whether a failed signed request shows that
+// the scorekeeper predates request signing: it answered 401 without
+// offering the signing scheme in its challenge, and has never accepted a
+// signed request from this process
+func shouldFallBackToBearer(err error) bool {
+	if cfg.AuthMode != authModeAuto || !useHMAC() || signedRequestAccepted.Load() {
+		return false
+	}
+	statusErr, ok := unauthorized(err)
+	return ok && !strings.Contains(statusErr.Challenge, hmacScheme)
+}
+
+// unauthorized returns the status error of a request answered with 401
+func unauthorized(err error) (*HTTPStatusError, bool) {
+	var statusErr *HTTPStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnauthorized {
+		return nil, false
+	}
+	return statusErr, true
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignRequest(t *testing.T) {
+	withConfig(t, &Config{BeaconID: "beacon-1"})
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		body   []byte
+		key    string
+	}{
+		{name: "get without body", method: "GET", url: "https://sk.example/api/tasks", key: "k1"},
+		{name: "post with body", method: "POST", url: "https://sk.example/api/claim", body: []byte(`{"task_id":"1"}`), key: "k1"},
+		{name: "query is signed", method: "GET", url: "https://sk.example/api/tasks?since=5", key: "another key"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, tt.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := signRequest(req, tt.body, tt.key); err != nil {
+				t.Fatalf("signRequest: %v", err)
+			}
+
+			bodyHash := sha256.Sum256(tt.body)
+			if got := req.Header.Get(requestContentHeader); got != hex.EncodeToString(bodyHash[:]) {
+				t.Errorf("%s = %q, want the body hash", requestContentHeader, got)
+			}
+			timestamp := req.Header.Get(requestTimestampHeader)
+			var unix int64
+			if _, err := fmt.Sscan(timestamp, &unix); err != nil || time.Since(time.Unix(unix, 0)) > time.Minute {
+				t.Errorf("%s = %q, want the current Unix time", requestTimestampHeader, timestamp)
+			}
+			nonce := req.Header.Get(requestNonceHeader)
+			if len(nonce) != 32 {
+				t.Errorf("%s = %q, want 16 hex-encoded bytes", requestNonceHeader, nonce)
+			}
+
+			canonical := strings.Join([]string{hmacScheme, tt.method, req.URL.RequestURI(), timestamp, nonce, hex.EncodeToString(bodyHash[:])}, "\n")
+			mac := hmac.New(sha256.New, hmacSigningKey(tt.key))
+			mac.Write([]byte(canonical))
+			want := fmt.Sprintf(`%s beacon="beacon-1", signature="%s"`, hmacScheme, base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+			if got := req.Header.Get("Authorization"); got != want {
+				t.Errorf("Authorization = %q, want %q", got, want)
+			}
+
+			for name, values := range req.Header {
+				for _, v := range values {
+					if strings.Contains(v, tt.key) {
+						t.Errorf("header %s carries the key", name)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSignRequestNonceIsUnique(t *testing.T) {
+	withConfig(t, &Config{BeaconID: "beacon-1"})
+
+	seen := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		req, _ := http.NewRequest("GET", "https://sk.example/api/tasks", nil)
+		if err := signRequest(req, nil, "k1"); err != nil {
+			t.Fatal(err)
+		}
+		nonce := req.Header.Get(requestNonceHeader)
+		if seen[nonce] {
+			t.Fatalf("nonce %s repeated", nonce)
+		}
+		seen[nonce] = true
+	}
+}
+
+// resetBearerFallback returns auto mode to its initial state for the
+// duration of a test
+func resetBearerFallback(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		cancelBearerFallback()
+		signedRequestAccepted.Store(false)
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestShouldFallBackToBearer(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     string
+		err      error
+		fallback bool
+		accepted bool // a signed request was accepted before
+		want     bool
+	}{
+		{name: "401 without challenge", mode: authModeAuto, err: &HTTPStatusError{StatusCode: 401}, want: true},
+		{name: "401 with other challenge", mode: authModeAuto, err: &HTTPStatusError{StatusCode: 401, Challenge: "Bearer"}, want: true},
+		{name: "401 offering signing", mode: authModeAuto, err: &HTTPStatusError{StatusCode: 401, Challenge: hmacScheme}, want: false},
+		{name: "403", mode: authModeAuto, err: &HTTPStatusError{StatusCode: 403}, want: false},
+		{name: "network error", mode: authModeAuto, err: fmt.Errorf("connection refused"), want: false},
+		{name: "success", mode: authModeAuto, err: nil, want: false},
+		{name: "hmac mode", mode: authModeHMAC, err: &HTTPStatusError{StatusCode: 401}, want: false},
+		{name: "bearer mode", mode: authModeBearer, err: &HTTPStatusError{StatusCode: 401}, want: false},
+		{name: "already falling back", mode: authModeAuto, err: &HTTPStatusError{StatusCode: 401}, fallback: true, want: false},
+		{name: "signed request accepted before", mode: authModeAuto, err: &HTTPStatusError{StatusCode: 401}, accepted: true, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, &Config{AuthMode: tt.mode})
+			resetBearerFallback(t)
+			if tt.fallback {
+				fallBackToBearer()
+			}
+			signedRequestAccepted.Store(tt.accepted)
+			if got := shouldFallBackToBearer(tt.err); got != tt.want {
+				t.Errorf("shouldFallBackToBearer = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBearerFallbackExpires(t *testing.T) {
+	withConfig(t, &Config{AuthMode: authModeAuto})
+	resetBearerFallback(t)
+
+	fallBackToBearer()
+	if useHMAC() {
+		t.Fatal("requests are still signed right after falling back")
+	}
+
+	bearerFallbackUntil.Store(time.Now().Add(-time.Second).UnixNano())
+	if !useHMAC() {
+		t.Fatal("requests are not signed again after bearerFallbackPeriod")
+	}
+}
+
+func TestAuthenticatedRequestBearerFallback(t *testing.T) {
+	tests := []struct {
+		name        string
+		acceptHMAC  int    // signed requests accepted before the scorekeeper starts refusing them
+		bearer      bool   // the scorekeeper accepts bearer auth
+		wantSchemes string // Authorization schemes received over two requests
+		wantErr     bool   // the second request fails
+	}{
+		{name: "scorekeeper without signing", bearer: true, wantSchemes: hmacScheme + " Bearer Bearer"},
+		{name: "key refused", wantSchemes: hmacScheme + " Bearer " + hmacScheme + " Bearer", wantErr: true},
+		{name: "signing accepted before", acceptHMAC: 1, bearer: true, wantSchemes: hmacScheme + " " + hmacScheme, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var schemes []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				scheme, _, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+				schemes = append(schemes, scheme)
+				if scheme == hmacScheme && tt.acceptHMAC > 0 {
+					tt.acceptHMAC--
+					return
+				}
+				if scheme == "Bearer" && tt.bearer {
+					return
+				}
+				w.WriteHeader(http.StatusUnauthorized)
+			}))
+			defer srv.Close()
+
+			c := defaultConfig()
+			c.AllowInsecureHTTP = true
+			c.AuthMode = authModeAuto
+			c.BeaconID = "beacon-1"
+			withConfig(t, c)
+			resetBearerFallback(t)
+
+			var err error
+			for i := 0; i < 2; i++ {
+				_, _, err = AuthenticatedGetRequest(context.Background(), srv.URL, "k1")
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("second request error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := strings.Join(schemes, " "); got != tt.wantSchemes {
+				t.Errorf("schemes = %q, want %q", got, tt.wantSchemes)
+			}
+		})
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Certificate rotation mirrors key rotation. The private key is generated on
+// the beacon and never leaves it:
+//
+//  1. rotateCert writes a new key to <client key>.pending and submits a CSR
+//     for it; the active certificate and key are untouched.
+//  2. The scorekeeper acknowledges the CSR with the signed certificate.
+//  3. installClientCertificate checks that the certificate matches the
+//     pending key, writes it to <client cert>.pending and then renames the
+//     key and the certificate into place, switching the key back if the
+//     certificate cannot follow.
+//
+// A certificate is only staged once it has been checked, so if the beacon is
+// interrupted during step 3, recoverCertRotation finishes the install.
+
+func init() {
+	registerTaskHandler(rotateCertHandler{})
+}
+
+// rotateCertHandler replaces the beacon's TLS client certificate
+type rotateCertHandler struct{}
+
+func (rotateCertHandler) Type() string {
+	return "rotate_cert"
+}
+
+func (rotateCertHandler) Validate(task Task) error {
+	if cfg.TLSClientCertFile == "" {
+		return fmt.Errorf("tls_client_cert_file and tls_client_key_file are not configured")
+	}
+	return nil
+}
+
+func (rotateCertHandler) Run(ctx context.Context, task Task) (TaskResult, error) {
+	resp, err := rotateCert()
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Exclusive keeps the client certificate from changing under other requests
+func (rotateCertHandler) Exclusive() bool {
+	return true
+}
+
+// Resume resubmits the recorded CSR only while its key is still staged
+func (rotateCertHandler) Resume(task Task, recorded json.RawMessage) (TaskResult, bool) {
+	var resp certRotationResponse
+	if err := json.Unmarshal(recorded, &resp); err != nil {
+		return nil, false
+	}
+	block, _ := pem.Decode([]byte(resp.CSR))
+	if block == nil {
+		return nil, false
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, false
+	}
+	if key, err := readPendingClientKey(); err != nil || !publicKeysEqual(key.Public(), csr.PublicKey) {
+		return nil, false
+	}
+	return resp, true
+}
+
+// Endpoint implements TaskResult
+func (r certRotationResponse) Endpoint() string {
+	return "rotate_cert"
+}
+
+// Acknowledged implements TaskResult; the certificate arrives with the
+// response, see AcknowledgedWithResponse
+func (r certRotationResponse) Acknowledged(ctx context.Context) error {
+	return fmt.Errorf("no certificate in the scorekeeper's response")
+}
+
+// AcknowledgedWithResponse installs the certificate the scorekeeper signed
+func (r certRotationResponse) AcknowledgedWithResponse(ctx context.Context, response []byte) error {
+	var ack certRotationAck
+	if err := json.Unmarshal(response, &ack); err != nil || ack.Certificate == "" {
+		return fmt.Errorf("no certificate in the scorekeeper's response")
+	}
+	cert, err := installClientCertificate([]byte(ack.Certificate))
+	if err != nil {
+		return fmt.Errorf("failed to install the new certificate: %v", err)
+	}
+
+	logger.Info("Installed new client certificate", "subject", cert.Subject.CommonName, "valid_until", cert.NotAfter)
+	reportEvent(ctx, "certificate_installed", certificateDetails(cert))
+	return nil
+}
+
+// pendingClientKeyPath returns the path of the key awaiting its certificate
+func pendingClientKeyPath() string {
+	return cfg.TLSClientKeyFile + ".pending"
+}
+
+// pendingClientCertPath returns the path of a checked certificate that is
+// being installed
+func pendingClientCertPath() string {
+	return cfg.TLSClientCertFile + ".pending"
+}
+
+// rotateCert generates a new client key, stages it and returns a CSR for it
+func rotateCert() (certRotationResponse, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return certRotationResponse{}, newTaskError(ErrCodeCertRotation, "failed to generate key: %v", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return certRotationResponse{}, newTaskError(ErrCodeCertRotation, "failed to encode key: %v", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := writeFileAtomic(pendingClientKeyPath(), keyPEM, 0600); err != nil {
+		return certRotationResponse{}, newTaskError(ErrCodeCertRotation, "failed to write pending key: %v", err)
+	}
+
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: cfg.BeaconID},
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return certRotationResponse{}, newTaskError(ErrCodeCertRotation, "failed to create CSR: %v", err)
+	}
+
+	return certRotationResponse{
+		CSR: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})),
+	}, nil
+}
+
+// readPendingClientKey loads the staged private key
+func readPendingClientKey() (crypto.Signer, error) {
+	data, err := os.ReadFile(pendingClientKeyPath())
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("pending key is not PEM encoded")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported pending key type %T", key)
+	}
+	return signer, nil
+}
+
+// installClientCertificate checks a signed certificate against the pending
+// key and makes both active
+func installClientCertificate(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("certificate is not PEM encoded")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate: %v", err)
+	}
+
+	key, err := readPendingClientKey()
+	if err != nil {
+		return nil, fmt.Errorf("no pending key: %v", err)
+	}
+	if !publicKeysEqual(key.Public(), cert.PublicKey) {
+		return nil, fmt.Errorf("certificate does not match the pending key")
+	}
+	if time.Now().After(cert.NotAfter) {
+		return nil, fmt.Errorf("certificate expired at %s", cert.NotAfter.Format(time.RFC3339))
+	}
+
+	if err := writeFileAtomic(pendingClientCertPath(), certPEM, 0644); err != nil {
+		return nil, fmt.Errorf("failed to stage certificate: %v", err)
+	}
+	if err := activateClientCertificate(); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// clientCertMu keeps handshakes from loading the client key and certificate
+// while activateClientCertificate is switching them
+var clientCertMu sync.RWMutex
+
+// previousClientKeyPath returns the path the replaced key is kept at until
+// its certificate has been replaced too
+func previousClientKeyPath() string {
+	return cfg.TLSClientKeyFile + ".prev"
+}
+
+// activateClientCertificate renames the staged key and certificate into
+// place and drops idle connections made with the old certificate. If the
+// certificate cannot be renamed, the key is switched back so that the active
+// pair keeps matching and the install can be retried.
+func activateClientCertificate() error {
+	clientCertMu.Lock()
+	defer clientCertMu.Unlock()
+
+	_, err := os.Stat(pendingClientKeyPath())
+	keyStaged := err == nil
+	hasPrevious := false
+	if keyStaged {
+		os.Remove(previousClientKeyPath())
+		if err := os.Link(cfg.TLSClientKeyFile, previousClientKeyPath()); err == nil {
+			hasPrevious = true
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to keep current key: %v", err)
+		}
+		if err := os.Rename(pendingClientKeyPath(), cfg.TLSClientKeyFile); err != nil {
+			os.Remove(previousClientKeyPath())
+			return fmt.Errorf("failed to activate pending key: %v", err)
+		}
+		syncDir(filepath.Dir(cfg.TLSClientKeyFile))
+	}
+
+	if err := os.Rename(pendingClientCertPath(), cfg.TLSClientCertFile); err != nil {
+		if keyStaged {
+			if rollbackErr := rollbackClientKey(hasPrevious); rollbackErr != nil {
+				logger.Error("Failed to switch back to the previous client key", "error", rollbackErr)
+			}
+		}
+		return fmt.Errorf("failed to activate certificate: %v", err)
+	}
+	syncDir(filepath.Dir(cfg.TLSClientCertFile))
+	os.Remove(previousClientKeyPath())
+
+	getHTTPClient().CloseIdleConnections()
+	return nil
+}
+
+// rollbackClientKey stages the newly activated key again and restores the
+// key it replaced, if there was one
+func rollbackClientKey(hasPrevious bool) error {
+	if err := os.Rename(cfg.TLSClientKeyFile, pendingClientKeyPath()); err != nil {
+		return err
+	}
+	if hasPrevious {
+		if err := os.Rename(previousClientKeyPath(), cfg.TLSClientKeyFile); err != nil {
+			return err
+		}
+	}
+	syncDir(filepath.Dir(cfg.TLSClientKeyFile))
+	return nil
+}
+
+// recoverCertRotation finishes a certificate install interrupted by a crash
+// or restart. It runs once at daemon startup.
+func recoverCertRotation() {
+	if cfg.TLSClientCertFile == "" {
+		return
+	}
+	if _, err := os.Stat(pendingClientCertPath()); err != nil {
+		return
+	}
+
+	logger.Info("Found unfinished certificate install, completing it")
+	if err := activateClientCertificate(); err != nil {
+		logger.Error("Failed to complete certificate install", "error", err)
+	}
+}
+
+// publicKeysEqual reports whether two public keys are the same
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	ka, err := x509.MarshalPKIXPublicKey(a)
+	if err != nil {
+		return false
+	}
+	kb, err := x509.MarshalPKIXPublicKey(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ka, kb)
+}
+
+// certificateDetails describes a certificate for events and logs
+func certificateDetails(cert *x509.Certificate) map[string]string {
+	fingerprint := sha256.Sum256(cert.Raw)
+	return map[string]string{
+		"subject":    cert.Subject.CommonName,
+		"serial":     cert.SerialNumber.String(),
+		"not_before": cert.NotBefore.UTC().Format(time.RFC3339),
+		"not_after":  cert.NotAfter.UTC().Format(time.RFC3339),
+		"sha256":     hex.EncodeToString(fingerprint[:]),
+	}
+}
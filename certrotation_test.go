@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestActivateClientCertificate(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string // by suffix of the client key or certificate path
+		want  map[string]string
+	}{
+		{
+			name:  "switches key and certificate",
+			files: map[string]string{"key": "old key", "cert": "old cert", "key.pending": "new key", "cert.pending": "new cert"},
+			want:  map[string]string{"key": "new key", "cert": "new cert"},
+		},
+		{
+			name:  "first certificate",
+			files: map[string]string{"key.pending": "new key", "cert.pending": "new cert"},
+			want:  map[string]string{"key": "new key", "cert": "new cert"},
+		},
+		{
+			name:  "key already switched before a restart",
+			files: map[string]string{"key": "new key", "cert": "old cert", "cert.pending": "new cert"},
+			want:  map[string]string{"key": "new key", "cert": "new cert"},
+		},
+		{
+			name:  "certificate cannot follow the key",
+			files: map[string]string{"key": "old key", "cert": "old cert", "key.pending": "new key"},
+			want:  map[string]string{"key": "old key", "cert": "old cert", "key.pending": "new key"},
+		},
+		{
+			name:  "first certificate cannot follow the key",
+			files: map[string]string{"key.pending": "new key"},
+			want:  map[string]string{"key.pending": "new key"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			c := defaultConfig()
+			c.TLSClientKeyFile = filepath.Join(dir, "key")
+			c.TLSClientCertFile = filepath.Join(dir, "cert")
+			withConfig(t, c)
+			for name, content := range tt.files {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := activateClientCertificate()
+			_, certStaged := tt.files["cert.pending"]
+			if (err == nil) != certStaged {
+				t.Errorf("activateClientCertificate error = %v", err)
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]string{}
+			for _, entry := range entries {
+				content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got[entry.Name()] = string(content)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("files = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,17 +1,31 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"runtime"
 	"strings"
+	"text/tabwriter"
+	"time"
 )
 
-// showStatus displays the current service status
+// showStatus displays the current service status, live from the daemon's
+// control socket when it is running, or from the service manager otherwise
 func showStatus() {
 	fmt.Println("Service: Tally")
 
+	resp, err := sendControlCommand(controlStatus)
+	if err == nil && resp.Status != nil {
+		showLiveStatus(*resp.Status)
+		return
+	}
+	if errors.Is(err, os.ErrPermission) {
+		fmt.Println("Live status: permission denied (run as root)")
+	}
+
 	switch runtime.GOOS {
 	case "darwin":
 		// Check launchctl
@@ -64,6 +78,192 @@ func showStatus() {
 	}
 
 	fmt.Printf("Log file: %s\n", getLogFilePath())
+	showInstanceLock()
+
+	showDaemonStatus()
+}
+
+// showInstanceLock prints which process holds the instance lock
+func showInstanceLock() {
+	pid, held, err := instanceLockHolder()
+	switch {
+	case err != nil:
+		fmt.Printf("Instance lock: unknown (%v)\n", err)
+	case !held:
+		fmt.Println("Instance lock: free")
+	case pid > 0:
+		fmt.Printf("Instance lock: held by PID %d\n", pid)
+	default:
+		fmt.Println("Instance lock: held")
+	}
+}
+
+// showLiveStatus prints the status served by the running daemon
+func showLiveStatus(status liveStatus) {
+	fmt.Printf("Status: Running (PID %d, since %s)\n", status.PID, formatStatusTime(status.StartedAt))
+	if status.Paused {
+		fmt.Println("Task cycles: paused")
+	}
+	fmt.Printf("Log file: %s\n", getLogFilePath())
+	if status.KeyFingerprint != "" {
+		fmt.Printf("Key fingerprint: %s\n", status.KeyFingerprint)
+	}
+	printDaemonStatus(status.daemonStatus)
+
+	if len(status.RecentErrors) > 0 {
+		fmt.Println("Recent errors:")
+		for _, e := range status.RecentErrors {
+			fmt.Printf("  %s  %s\n", e.Time.Local().Format(time.RFC3339), e.Message)
+		}
+	}
+}
+
+// showDaemonStatus prints the poll schedule last recorded by the daemon
+func showDaemonStatus() {
+	status, err := readDaemonStatus()
+	if err != nil {
+		fmt.Printf("Poll interval: %s (configured, daemon has not reported yet)\n", cfg.Interval)
+		return
+	}
+	printDaemonStatus(status)
+}
+
+// printDaemonStatus prints a daemon status snapshot
+func printDaemonStatus(status daemonStatus) {
+	if status.EffectiveInterval == "" {
+		fmt.Printf("Poll interval: %s (configured, first cycle still running)\n", cfg.Interval)
+		fmt.Printf("Outbox: %d results waiting\n", status.OutboxDepth)
+		return
+	}
+
+	if status.ServerInterval != "" {
+		fmt.Printf("Poll interval: %s (server requested %s, configured %s)\n", status.EffectiveInterval, status.ServerInterval, status.ConfiguredInterval)
+	} else {
+		fmt.Printf("Poll interval: %s (configured)\n", status.EffectiveInterval)
+	}
+	fmt.Printf("Jitter: ±%.0f%%\n", status.Jitter*100)
+	fmt.Printf("Last cycle: %s\n", formatStatusTime(status.LastCycle))
+	if status.LastCycleError != "" {
+		fmt.Printf("Last cycle error: %s\n", status.LastCycleError)
+	}
+	fmt.Printf("Last successful cycle: %s\n", formatStatusTime(status.LastSuccess))
+	fmt.Printf("Last heartbeat: %s\n", formatStatusTime(status.LastHeartbeat))
+	fmt.Printf("Next poll: %s\n", status.NextPoll.Format(time.RFC3339))
+	fmt.Printf("Circuit breaker: %s\n", describeBreaker(status.Breaker, status.BreakerOpenUntil))
+	fmt.Printf("Outbox: %d results waiting\n", status.OutboxDepth)
+}
+
+// formatStatusTime formats a status timestamp, which is zero until the
+// event first happens
+func formatStatusTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// runOutboxCommand handles `tally outbox list|retry|purge`
+func runOutboxCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: tally outbox list|retry|purge <seq>...|all")
+	}
+
+	// Changing the outbox under a running daemon could submit a result twice
+	if args[0] != "list" {
+		if err := acquireInstanceLock(); err != nil {
+			return fmt.Errorf("%v; stop it before changing the outbox", err)
+		}
+	}
+
+	o, err := openOutbox(statePath("outbox"))
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		return listOutbox(o)
+
+	case "retry":
+		// Acknowledged results are recorded like the daemon would
+		l, err := openLedger(statePath("ledger.json"))
+		if err != nil {
+			return err
+		}
+		ledger = l
+		resultOutbox = o
+		if err := o.requeueRejected(); err != nil {
+			return err
+		}
+
+		before := o.depth()
+		err = o.flush(context.Background())
+		fmt.Printf("Submitted %d of %d results\n", before-o.depth(), before)
+		return err
+
+	case "purge":
+		return purgeOutbox(o, args[1:])
+	}
+
+	return fmt.Errorf("unknown outbox command %q (valid: list, retry, purge)", args[0])
+}
+
+// listOutbox prints every queued result
+func listOutbox(o *outbox) error {
+	entries, err := o.entries()
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Println("Outbox is empty")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SEQ\tTASK\tTYPE\tQUEUED\tSTATE\tATTEMPTS\tLAST ERROR")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\t%s\n", entry.Seq, entry.Task.ID, entry.Task.TaskType,
+			entry.CreatedAt.Local().Format(time.RFC3339), entry.state(), entry.Attempts, entry.LastError)
+	}
+	return w.Flush()
+}
+
+// purgeOutbox removes the given entries, or all of them, without submitting
+// them; the scorekeeper may hand out the purged tasks again
+func purgeOutbox(o *outbox, targets []string) error {
+	if len(targets) == 0 {
+		return fmt.Errorf("usage: tally outbox purge <seq>...|all")
+	}
+
+	var seqs []uint64
+	if len(targets) == 1 && targets[0] == "all" {
+		entries, err := o.entries()
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			seqs = append(seqs, entry.Seq)
+		}
+	} else {
+		for _, target := range targets {
+			seq, err := parseOutboxSeq(target)
+			if err != nil {
+				return err
+			}
+			seqs = append(seqs, seq)
+		}
+	}
+
+	for _, seq := range seqs {
+		if _, err := os.Stat(o.entryPath(seq)); err != nil {
+			return fmt.Errorf("no outbox entry %d", seq)
+		}
+		if err := o.remove(seq); err != nil {
+			return fmt.Errorf("failed to purge outbox entry %d: %v", seq, err)
+		}
+	}
+	fmt.Printf("Purged %d results\n", len(seqs))
+	return nil
 }
 
 // showLogs displays recent log entries
@@ -1,59 +1,577 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
-)
+	"time"
 
-// Configuration variables for the Tally beacon service
-var (
-	INTERVAL = 60 // in seconds
-	ENDPOINT = "http://10.100.7.8:8000"
+	"gopkg.in/yaml.v3"
 )
 
-func GetKeyFilePath() (string, error) {
-	var keyfilePath string
+// Config holds the runtime configuration for the Tally beacon service.
+// Values are resolved in order of increasing precedence: built-in defaults,
+// the config file, TALLY_* environment variables and command-line flags.
+// Every field is exposed under its yaml name in the config file, as
+// TALLY_<NAME> in the environment and as -<name> (underscores become dashes)
+// on the command line.
+type Config struct {
+	Endpoint string   `yaml:"endpoint" usage:"scorekeeper base URL, e.g. https://10.0.0.5:8000 (https is assumed without a scheme)"`
+	Interval Duration `yaml:"interval" usage:"time between task cycles (seconds or a duration such as 1m)"`
+	KeyFile  string   `yaml:"key_file" usage:"path to the beacon API key file (file and encrypted_file secret stores)"`
+	BeaconID string   `yaml:"beacon_id" usage:"identifier reported with every result (default: the enrolled ID, else the hostname)"`
+	StateDir string   `yaml:"state_dir" usage:"directory for persistent beacon state"`
+
+	// The scorekeeper may override the interval with next_poll_seconds;
+	// overrides are clamped to [min_interval, max_interval]
+	MinInterval Duration `yaml:"min_interval" usage:"lower bound for server-requested poll intervals"`
+	MaxInterval Duration `yaml:"max_interval" usage:"upper bound for server-requested poll intervals"`
+	Jitter      float64  `yaml:"jitter" usage:"random jitter applied to each poll, as a fraction of the interval (0-1)"`
+
+	SecretStore   string `yaml:"secret_store" usage:"where the beacon key is kept: file, encrypted_file, systemd, env or keyring"`
+	SecretName    string `yaml:"secret_name" usage:"credential name (systemd), variable name (env) or key name prefix (keyring)"`
+	SecretKeyFile string `yaml:"secret_key_file" usage:"32-byte AES key (raw, hex or base64) used by the encrypted_file secret store"`
+
+	KeyGracePeriod   Duration `yaml:"key_grace_period" usage:"how long the previous key is kept as a fallback after rotation"`
+	KeyWatchInterval Duration `yaml:"key_watch_interval" usage:"how often the key file is checked for tampering (a fallback where change notifications work)"`
+
+	LedgerRetention Duration `yaml:"ledger_retention" usage:"how long completed task IDs are remembered"`
+
+	Workers         int      `yaml:"workers" usage:"maximum number of tasks executed concurrently"`
+	TaskTimeout     Duration `yaml:"task_timeout" usage:"how long a task may run unless the scorekeeper sets timeout_seconds"`
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" usage:"how long stopping the service waits for in-flight work"`
+
+	HeartbeatInterval Duration `yaml:"heartbeat_interval" usage:"time between heartbeats (0 sends one with every task cycle)"`
+
+	HTTPTimeout      Duration `yaml:"http_timeout" usage:"overall timeout for each scorekeeper request"`
+	HTTPDialTimeout  Duration `yaml:"http_dial_timeout" usage:"timeout for connecting to the scorekeeper"`
+	HTTPTLSTimeout   Duration `yaml:"http_tls_timeout" usage:"timeout for the TLS handshake with the scorekeeper"`
+	MaxResponseBytes int64    `yaml:"max_response_bytes" usage:"largest scorekeeper response body accepted"`
+
+	TLSCAFile         string   `yaml:"tls_ca_file" usage:"PEM bundle of CAs trusted for the scorekeeper instead of the system roots"`
+	TLSPins           []string `yaml:"tls_pins" usage:"accepted scorekeeper keys (sha256//<base64 SPKI hash>) or certificate SHA-256 fingerprints, comma-separated"`
+	AllowInsecureHTTP bool     `yaml:"allow_insecure_http" usage:"allow sending the beacon key to an http:// endpoint"`
+	TLSClientCertFile string   `yaml:"tls_client_cert_file" usage:"PEM client certificate presented to the scorekeeper (enables mutual TLS)"`
+	TLSClientKeyFile  string   `yaml:"tls_client_key_file" usage:"PEM private key of the client certificate"`
+
+	AuthMode string `yaml:"auth_mode" usage:"request authentication: auto, hmac or bearer"`
+
+	TaskSigningKey      string   `yaml:"task_signing_key" usage:"base64 Ed25519 public key that must have signed every task list"`
+	TaskSignatureMaxAge Duration `yaml:"task_signature_max_age" usage:"oldest signed task list accepted, and largest clock skew tolerated"`
+
+	RetryAttempts      int      `yaml:"retry_attempts" usage:"attempts per scorekeeper request before giving up"`
+	RetryBaseDelay     Duration `yaml:"retry_base_delay" usage:"delay before the first retry, doubled on each attempt"`
+	RetryMaxDelay      Duration `yaml:"retry_max_delay" usage:"longest delay between retries"`
+	BreakerThreshold   int      `yaml:"breaker_threshold" usage:"consecutive failures that open the circuit breaker"`
+	BreakerCooldown    Duration `yaml:"breaker_cooldown" usage:"how long the circuit breaker stays open at first"`
+	BreakerMaxCooldown Duration `yaml:"breaker_max_cooldown" usage:"longest the circuit breaker stays open"`
+
+	PolicyFile       string   `yaml:"policy_file" usage:"root-owned allowlist of file paths tasks may use"`
+	ControlFileOwner string   `yaml:"control_file_owner" usage:"user name or UID that must own control files (optional)"`
+	FileReadTimeout  Duration `yaml:"file_read_timeout" usage:"maximum time allowed for reading a task file"`
+
+	LogFormat string `yaml:"log_format" usage:"log output: text or json"`
+	LogLevel  string `yaml:"log_level" usage:"lowest level logged: debug, info, warn or error"`
+
+	controlFileOwnerUID int
+	tlsRootCAs          *x509.CertPool
+	tlsPins             []tlsPin
+	taskSigningKey      ed25519.PublicKey
+	secretStore         SecretStore
+	logLevel            slog.Level
+}
+
+// Global configuration instance
+var cfg = defaultConfig()
+
+// defaultConfig returns the built-in configuration defaults
+func defaultConfig() *Config {
+	return &Config{
+		Interval:    Duration(60 * time.Second),
+		KeyFile:     defaultKeyFilePath(),
+		StateDir:    defaultStateDir(),
+		MinInterval: Duration(5 * time.Second),
+		MaxInterval: Duration(time.Hour),
+		Jitter:      0.1,
+
+		SecretStore: secretStoreFile,
+
+		KeyGracePeriod:   Duration(10 * time.Minute),
+		KeyWatchInterval: Duration(10 * time.Second),
+
+		LedgerRetention: Duration(7 * 24 * time.Hour),
+
+		Workers:         4,
+		TaskTimeout:     Duration(30 * time.Second),
+		ShutdownTimeout: Duration(10 * time.Second),
+
+		HTTPTimeout:      Duration(30 * time.Second),
+		HTTPDialTimeout:  Duration(10 * time.Second),
+		HTTPTLSTimeout:   Duration(10 * time.Second),
+		MaxResponseBytes: 4 * 1024 * 1024,
+
+		AuthMode: authModeAuto,
+
+		TaskSignatureMaxAge: Duration(5 * time.Minute),
+
+		RetryAttempts:      3,
+		RetryBaseDelay:     Duration(time.Second),
+		RetryMaxDelay:      Duration(30 * time.Second),
+		BreakerThreshold:   5,
+		BreakerCooldown:    Duration(time.Minute),
+		BreakerMaxCooldown: Duration(10 * time.Minute),
+
+		PolicyFile:      defaultPolicyFilePath(),
+		FileReadTimeout: Duration(5 * time.Second),
+
+		LogFormat: logFormatText,
+		LogLevel:  "info",
+	}
+}
+
+// defaultStateDir returns the platform-specific state directory
+func defaultStateDir() string {
 	switch runtime.GOOS {
 	case "windows":
-		keyfilePath = "C:\\Users\\Administrator\\.netsiege"
-	case "linux":
-		keyfilePath = "/root/.netsiege"
-	case "darwin":
-		keyfilePath = "/Users/akshay/.netsiege"
+		return "C:\\Tally\\state"
 	default:
-		return "", fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
+		return "/var/lib/tally"
 	}
+}
 
-	_, err := os.Stat(keyfilePath)
+// defaultBeaconID returns the beacon ID assigned at enrollment, or the
+// hostname if the beacon has not been enrolled
+func defaultBeaconID(stateDir string) string {
+	if id := readTrimmed(filepath.Join(stateDir, beaconIDFile)); id != "" {
+		return id
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// defaultConfigFilePath returns the platform-specific config file path
+func defaultConfigFilePath() string {
+	switch runtime.GOOS {
+	case "windows":
+		return "C:\\Tally\\tally.yaml"
+	default:
+		return "/etc/tally/tally.yaml"
+	}
+}
+
+// LoadConfig resolves the configuration from the config file, environment
+// and the given command-line arguments, and validates the result
+func LoadConfig(args []string) (*Config, error) {
+	c, err := resolveConfig(args)
 	if err != nil {
-		return "", fmt.Errorf("failed to get key file info: %v", err)
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
 	}
+	return c, nil
+}
 
-	return keyfilePath, nil
+// LoadLocalConfig resolves the configuration like LoadConfig but only checks
+// what commands that inspect or control the local beacon use: the state
+// directory and the control socket. They need no endpoint or key.
+func LoadLocalConfig(args []string) (*Config, error) {
+	c, err := resolveConfig(args)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.validateLocal(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	return c, nil
 }
 
-func GetEndpointURL(path string) string {
-	base := strings.TrimSuffix(ENDPOINT, "/")
+// resolveConfig layers the config file, environment and command-line
+// arguments over the defaults without validating the result
+func resolveConfig(args []string) (*Config, error) {
+	// Flags are parsed into a scratch config first so that bad values are
+	// reported immediately, then re-applied once file and environment are in
+	scratch := defaultConfig()
+
+	fs := flag.NewFlagSet("tally", flag.ContinueOnError)
+	configPath := fs.String("config", "", "path to the config file (default "+defaultConfigFilePath()+")")
+	flagValues := map[string]string{}
+	for _, field := range configFields(scratch) {
+		name := field.flagName
+		set := func(s string) error {
+			if err := setConfigValue(field.value, s); err != nil {
+				return err
+			}
+			flagValues[name] = s
+			return nil
+		}
+		if field.value.Kind() == reflect.Bool {
+			fs.BoolFunc(name, field.usage, set)
+		} else {
+			fs.Func(name, field.usage, set)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	c := defaultConfig()
+
+	path := *configPath
+	explicit := path != ""
+	if !explicit {
+		path = os.Getenv("TALLY_CONFIG")
+		explicit = path != ""
+	}
+	if !explicit {
+		path = defaultConfigFilePath()
+	}
+	if err := c.loadFile(path, explicit); err != nil {
+		return nil, err
+	}
+
+	fields := configFields(c)
+	for _, field := range fields {
+		if s, ok := os.LookupEnv(field.envName); ok {
+			if err := setConfigValue(field.value, s); err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", field.envName, err)
+			}
+		}
+	}
+	for _, field := range fields {
+		if s, ok := flagValues[field.flagName]; ok {
+			if err := setConfigValue(field.value, s); err != nil {
+				return nil, fmt.Errorf("invalid -%s: %v", field.flagName, err)
+			}
+		}
+	}
+
+	if c.BeaconID == "" {
+		c.BeaconID = defaultBeaconID(c.StateDir)
+	}
+	return c, nil
+}
+
+// loadFile merges the YAML config file at path into c. A missing file is
+// only an error when the path was given explicitly.
+func (c *Config) loadFile(path string, explicit bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) && !explicit {
+			return nil
+		}
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// Validate checks that the configuration is usable by the daemon
+func (c *Config) Validate() error {
+	if c.Endpoint == "" {
+		return fmt.Errorf("endpoint is required (set endpoint in the config file, TALLY_ENDPOINT or -endpoint)")
+	}
+	u, err := url.Parse(endpointBase(c.Endpoint))
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("endpoint %q is not a valid URL", c.Endpoint)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("endpoint scheme must be http or https, got %q", u.Scheme)
+	}
+	if u.Scheme == "http" && !c.AllowInsecureHTTP {
+		return fmt.Errorf("endpoint %s uses plain http, which would expose the beacon key; use https or set allow_insecure_http", c.Endpoint)
+	}
+	store, err := newSecretStore(c)
+	if err != nil {
+		return err
+	}
+	c.secretStore = store
+	if c.TLSCAFile != "" {
+		pool, err := loadCABundle(c.TLSCAFile)
+		if err != nil {
+			return fmt.Errorf("tls_ca_file: %v", err)
+		}
+		c.tlsRootCAs = pool
+	}
+	if (c.TLSClientCertFile == "") != (c.TLSClientKeyFile == "") {
+		return fmt.Errorf("tls_client_cert_file and tls_client_key_file must be set together")
+	}
+	c.tlsPins = nil
+	for _, s := range c.TLSPins {
+		pin, err := parseTLSPin(s)
+		if err != nil {
+			return fmt.Errorf("tls_pins: %v", err)
+		}
+		c.tlsPins = append(c.tlsPins, pin)
+	}
+	switch c.AuthMode {
+	case authModeAuto, authModeHMAC, authModeBearer:
+	default:
+		return fmt.Errorf("auth_mode must be auto, hmac or bearer, got %q", c.AuthMode)
+	}
+	switch c.LogFormat {
+	case logFormatText, logFormatJSON:
+	default:
+		return fmt.Errorf("log_format must be text or json, got %q", c.LogFormat)
+	}
+	if err := c.logLevel.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return fmt.Errorf("log_level must be debug, info, warn or error, got %q", c.LogLevel)
+	}
+	c.taskSigningKey = nil
+	if c.TaskSigningKey != "" {
+		key, err := parseTaskSigningKey(c.TaskSigningKey)
+		if err != nil {
+			return fmt.Errorf("task_signing_key: %v", err)
+		}
+		c.taskSigningKey = key
+	}
+	if c.TaskSignatureMaxAge <= 0 {
+		return fmt.Errorf("task_signature_max_age must be positive")
+	}
+	if c.Interval.Duration() < time.Second {
+		return fmt.Errorf("interval must be at least 1s, got %s", c.Interval)
+	}
+	if c.MinInterval.Duration() < time.Second {
+		return fmt.Errorf("min_interval must be at least 1s, got %s", c.MinInterval)
+	}
+	if c.MaxInterval < c.MinInterval {
+		return fmt.Errorf("max_interval (%s) must not be below min_interval (%s)", c.MaxInterval, c.MinInterval)
+	}
+	if c.Jitter < 0 || c.Jitter > 1 {
+		return fmt.Errorf("jitter must be between 0 and 1, got %v", c.Jitter)
+	}
+	if c.BeaconID == "" {
+		return fmt.Errorf("beacon_id is required")
+	}
+	if c.Workers < 1 {
+		return fmt.Errorf("workers must be at least 1, got %d", c.Workers)
+	}
+	if c.HTTPTimeout <= 0 || c.HTTPDialTimeout <= 0 || c.HTTPTLSTimeout <= 0 {
+		return fmt.Errorf("http_timeout, http_dial_timeout and http_tls_timeout must be positive")
+	}
+	if c.MaxResponseBytes < 1024 {
+		return fmt.Errorf("max_response_bytes must be at least 1024, got %d", c.MaxResponseBytes)
+	}
+	if c.RetryAttempts < 1 {
+		return fmt.Errorf("retry_attempts must be at least 1, got %d", c.RetryAttempts)
+	}
+	if c.RetryBaseDelay <= 0 || c.RetryMaxDelay < c.RetryBaseDelay {
+		return fmt.Errorf("retry_base_delay must be positive and not above retry_max_delay")
+	}
+	if c.BreakerThreshold < 1 {
+		return fmt.Errorf("breaker_threshold must be at least 1, got %d", c.BreakerThreshold)
+	}
+	if c.BreakerCooldown <= 0 || c.BreakerMaxCooldown < c.BreakerCooldown {
+		return fmt.Errorf("breaker_cooldown must be positive and not above breaker_max_cooldown")
+	}
+	if c.KeyWatchInterval < Duration(time.Second) {
+		return fmt.Errorf("key_watch_interval must be at least 1s, got %s", c.KeyWatchInterval)
+	}
+	if c.TaskTimeout <= 0 || c.ShutdownTimeout <= 0 {
+		return fmt.Errorf("task_timeout and shutdown_timeout must be positive")
+	}
+	if c.HeartbeatInterval < 0 {
+		return fmt.Errorf("heartbeat_interval must not be negative")
+	}
+	if c.FileReadTimeout <= 0 {
+		return fmt.Errorf("file_read_timeout must be positive")
+	}
+	if c.ControlFileOwner != "" {
+		uid, err := lookupOwnerUID(c.ControlFileOwner)
+		if err != nil {
+			return fmt.Errorf("control_file_owner: %v", err)
+		}
+		c.controlFileOwnerUID = uid
+	}
+	return c.validateLocal()
+}
+
+// validateLocal checks the settings every command relies on
+func (c *Config) validateLocal() error {
+	if c.StateDir == "" {
+		return fmt.Errorf("state_dir is required")
+	}
+	if path := filepath.Join(c.StateDir, controlSocketFile); len(path) > maxControlSocketPath {
+		return fmt.Errorf("state_dir is too long for the control socket %s (max %d bytes)", path, maxControlSocketPath)
+	}
+	return nil
+}
+
+// configField binds one Config field to its environment variable and flag
+type configField struct {
+	envName  string
+	flagName string
+	usage    string
+	value    reflect.Value
+}
+
+// configFields lists the settable fields of c
+func configFields(c *Config) []configField {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+
+	var fields []configField
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		fields = append(fields, configField{
+			envName:  "TALLY_" + strings.ToUpper(name),
+			flagName: strings.ReplaceAll(name, "_", "-"),
+			usage:    t.Field(i).Tag.Get("usage"),
+			value:    v.Field(i),
+		})
+	}
+	return fields
+}
+
+// setConfigValue parses s into the config field v
+func setConfigValue(v reflect.Value, s string) error {
+	switch v.Interface().(type) {
+	case Duration:
+		d, err := parseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(d))
+		return nil
+	case []string:
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", s)
+		}
+		v.SetInt(int64(n))
+	case reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", s)
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", s)
+		}
+		v.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", s)
+		}
+		v.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported config type %s", v.Type())
+	}
+	return nil
+}
+
+// Duration is a time.Duration that accepts either a plain number of seconds
+// or a Go duration string such as "90s" or "5m" in the config file,
+// environment and flags
+type Duration time.Duration
+
+// Duration returns d as a time.Duration
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	parsed, err := parseDuration(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %v", node.Line, err)
+	}
+	*d = parsed
+	return nil
+}
+
+// parseDuration parses a number of seconds or a Go duration string
+func parseDuration(s string) (Duration, error) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseFloat(s, 64); err == nil {
+		return Duration(n * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return Duration(d), nil
+}
+
+// defaultKeyFilePath returns the platform-specific key file path
+func defaultKeyFilePath() string {
+	switch runtime.GOOS {
+	case "windows":
+		return "C:\\Tally\\tally.key"
+	default:
+		return "/etc/tally/tally.key"
+	}
+}
+
+// endpointBase normalizes the configured endpoint into a base URL,
+// defaulting to https
+func endpointBase(endpoint string) string {
+	base := strings.TrimSuffix(endpoint, "/")
 	if !strings.HasPrefix(base, "http://") && !strings.HasPrefix(base, "https://") {
-		base = "http://" + base
+		base = "https://" + base
 	}
+	return base
+}
+
+func GetEndpointURL(path string) string {
+	base := endpointBase(cfg.Endpoint)
 
 	cleanedPath := strings.TrimPrefix(path, "/")
 	return base + "/api/" + cleanedPath
 }
 
+// getKey returns the active beacon API key from the secret store
 func getKey() (string, error) {
-	keyFilePath, err := GetKeyFilePath()
-	if err != nil {
-		return "", err
+	key, err := secretStore().Get(slotActive)
+	if errors.Is(err, errSecretNotFound) {
+		return "", fmt.Errorf("no beacon key in the %s secret store: %v (run `tally enroll --token <join-token>` to enroll this beacon)", secretStore().Name(), err)
 	}
-
-	content, err := os.ReadFile(keyFilePath)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("failed to read key from the %s secret store: %v", secretStore().Name(), err)
 	}
-
-	return string(content), nil
+	return key, nil
 }
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withConfig replaces the global config for the duration of a test
+func withConfig(t *testing.T, c *Config) {
+	t.Helper()
+	old := cfg
+	cfg = c
+	t.Cleanup(func() { cfg = old })
+}
+
+// clearTallyEnv unsets every TALLY_* variable for the duration of a test
+func clearTallyEnv(t *testing.T) {
+	t.Helper()
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(name, "TALLY_") {
+			t.Setenv(name, "")
+			os.Unsetenv(name)
+		}
+	}
+}
+
+// writeTestConfig writes a config file with a valid endpoint, key file and
+// state directory followed by extra, sets env in a clean TALLY_*
+// environment and returns the file's path
+func writeTestConfig(t *testing.T, extra string, env map[string]string) string {
+	t.Helper()
+	clearTallyEnv(t)
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+
+	dir := t.TempDir()
+	base := "endpoint: https://scorekeeper.example\nbeacon_id: test\n" +
+		"key_file: " + filepath.Join(dir, "key") + "\nstate_dir: " + dir + "\n"
+	path := filepath.Join(dir, "tally.yaml")
+	if err := os.WriteFile(path, []byte(base+extra), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name         string
+		file         string
+		env          map[string]string
+		args         []string
+		wantInterval time.Duration
+		wantWorkers  int
+		wantLevel    string
+	}{
+		{
+			name:         "defaults",
+			wantInterval: 60 * time.Second,
+			wantWorkers:  4,
+			wantLevel:    "info",
+		},
+		{
+			name:         "file overrides defaults",
+			file:         "interval: 30\nworkers: 2\n",
+			wantInterval: 30 * time.Second,
+			wantWorkers:  2,
+			wantLevel:    "info",
+		},
+		{
+			name:         "environment overrides file",
+			file:         "interval: 30\nworkers: 2\nlog_level: warn\n",
+			env:          map[string]string{"TALLY_INTERVAL": "40s", "TALLY_WORKERS": "6"},
+			wantInterval: 40 * time.Second,
+			wantWorkers:  6,
+			wantLevel:    "warn",
+		},
+		{
+			name:         "flags override environment and file",
+			file:         "interval: 30\nworkers: 2\nlog_level: warn\n",
+			env:          map[string]string{"TALLY_INTERVAL": "40s", "TALLY_LOG_LEVEL": "error"},
+			args:         []string{"-interval", "50s", "-log-level", "debug"},
+			wantInterval: 50 * time.Second,
+			wantWorkers:  2,
+			wantLevel:    "debug",
+		},
+		{
+			name:         "flags override defaults without file",
+			args:         []string{"-workers", "8"},
+			wantInterval: 60 * time.Second,
+			wantWorkers:  8,
+			wantLevel:    "info",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestConfig(t, tt.file, tt.env)
+
+			c, err := LoadConfig(append([]string{"-config", path}, tt.args...))
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			if got := c.Interval.Duration(); got != tt.wantInterval {
+				t.Errorf("interval = %s, want %s", got, tt.wantInterval)
+			}
+			if c.Workers != tt.wantWorkers {
+				t.Errorf("workers = %d, want %d", c.Workers, tt.wantWorkers)
+			}
+			if c.LogLevel != tt.wantLevel {
+				t.Errorf("log_level = %q, want %q", c.LogLevel, tt.wantLevel)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		args    []string
+		wantErr string
+	}{
+		{
+			name:    "unknown file field",
+			file:    "intervall: 30\n",
+			wantErr: "failed to parse config file",
+		},
+		{
+			name:    "invalid environment value",
+			env:     map[string]string{"TALLY_WORKERS": "many"},
+			wantErr: "invalid TALLY_WORKERS",
+		},
+		{
+			name:    "invalid flag value",
+			args:    []string{"-interval", "soon"},
+			wantErr: "interval",
+		},
+		{
+			name:    "plain http without allow_insecure_http",
+			args:    []string{"-endpoint", "http://scorekeeper.example"},
+			wantErr: "plain http",
+		},
+		{
+			name:    "invalid auth mode",
+			env:     map[string]string{"TALLY_AUTH_MODE": "basic"},
+			wantErr: "auth_mode",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestConfig(t, tt.file, tt.env)
+
+			_, err := LoadConfig(append([]string{"-config", path}, tt.args...))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("LoadConfig error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadLocalConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		wantErr string
+	}{
+		{name: "no endpoint", env: map[string]string{"TALLY_ENDPOINT": ""}},
+		{name: "missing CA bundle", args: []string{"-tls-ca-file", "/nonexistent/ca.pem"}},
+		{name: "invalid auth mode", env: map[string]string{"TALLY_AUTH_MODE": "basic"}},
+		{name: "no state dir", args: []string{"-state-dir", ""}, wantErr: "state_dir is required"},
+		{name: "state dir too long for the socket", args: []string{"-state-dir", "/" + strings.Repeat("a", 100)}, wantErr: "too long"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestConfig(t, "", tt.env)
+
+			_, err := LoadLocalConfig(append([]string{"-config", path}, tt.args...))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadLocalConfig: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("LoadLocalConfig error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
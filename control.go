@@ -1,84 +1,118 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"strings"
 )
 
+func init() {
+	registerTaskHandler(checkControlHandler{})
+}
+
+// checkControlHandler reads a control file and claims its contents
+type checkControlHandler struct{}
+
+func (checkControlHandler) Type() string {
+	return "check_control"
+}
+
+func (checkControlHandler) Validate(task Task) error {
+	if task.FilePath == "" {
+		return fmt.Errorf("file_path is required")
+	}
+	return nil
+}
+
+func (checkControlHandler) Run(ctx context.Context, task Task) (TaskResult, error) {
+	return checkControl(ctx, task)
+}
+
+// Resume resubmits the recorded claim; the control file is only cleared
+// once the scorekeeper has it, so running the check again could claim
+// content that was already scored
+func (checkControlHandler) Resume(task Task, recorded json.RawMessage) (TaskResult, bool) {
+	var resp controlCheckResponse
+	if err := json.Unmarshal(recorded, &resp); err != nil {
+		return nil, false
+	}
+	return resp, true
+}
+
+// Endpoint implements TaskResult
+func (r controlCheckResponse) Endpoint() string {
+	return "claim"
+}
+
+// Acknowledged clears the control file once the claim has been accepted
+func (r controlCheckResponse) Acknowledged(ctx context.Context) error {
+	if err := clearControlFile(r.FilePath); err != nil {
+		return fmt.Errorf("failed to clear control file %s: %v", r.FilePath, err)
+	}
+	return nil
+}
+
+// maxTaskFileSize is the largest file a task will read
+const maxTaskFileSize = 1 * 1024 * 1024
+
 // checkControl verifies the existence and accessibility of a control file
-// and returns its contents if successful
-func checkControl(task Task) (controlCheckResponse, error) {
+// and returns its contents if successful. Failures are returned as a
+// *taskError alongside whatever was learned about the file.
+func checkControl(ctx context.Context, task Task) (controlCheckResponse, error) {
 	// Handles these cases:
 	// 1. file does not exist
 	// 2. file exists but cannot be accessed (permission denied)
-	// 3. file exists but is too large (over 1MB)
-	// 4. file exists but is empty
-	// 5. file exists and is accessible, return content
-
-	fileStats, err := os.Stat(task.FilePath)
-	if os.IsNotExist(err) {
-		return controlCheckResponse{
-			Success:     false,
-			FilePath:    task.FilePath,
-			FileExists:  false,
-			AccessError: "[NOTEXIST] - file does not exist",
-		}, nil
-	}
+	// 3. file is a symlink, hard link, FIFO, device or has the wrong owner
+	// 4. file exists but is too large (over 1MB)
+	// 5. file exists but is empty
+	// 6. file exists and is accessible, return content
+
+	resp := controlCheckResponse{FilePath: task.FilePath}
 
+	content, err := readTaskFile(ctx, task.FilePath, true)
 	if err != nil {
-		return controlCheckResponse{
-			Success:     false,
-			FilePath:    task.FilePath,
-			FileExists:  false,
-			AccessError: err.Error(),
-		}, nil
+		var te *taskError
+		resp.FileExists = !errors.As(err, &te) || te.Code != ErrCodeNotExist
+		return resp, err
 	}
+	resp.FileExists = true
 
-	// check file size (1 MB limit)
-	if fileStats.Size() > 1*1024*1024 {
-		return controlCheckResponse{
-			Success:     false,
-			FilePath:    task.FilePath,
-			FileExists:  true,
-			AccessError: "[MAXSIZE] - file too large (over 1MB)",
-		}, nil
+	if len(content) == 0 {
+		return resp, newTaskError(ErrCodeEmpty, "file is empty")
 	}
 
-	if fileStats.Size() == 0 {
-		return controlCheckResponse{
-			Success:     false,
-			FilePath:    task.FilePath,
-			FileExists:  true,
-			AccessError: "[EMPTY] - file is empty",
-		}, nil
-	}
+	// Clean the content by removing newlines
+	resp.FileContent = strings.ReplaceAll(string(content), "\n", "")
 
-	content, err := os.ReadFile(task.FilePath)
-	if err != nil {
-		return controlCheckResponse{
-			Success:     false,
-			FilePath:    task.FilePath,
-			FileExists:  true,
-			AccessError: err.Error(),
-		}, nil
-	}
+	return resp, nil
+}
 
-	// Clean the content by removing newlines
-	cleaned := strings.ReplaceAll(string(content), "\n", "")
-
-	return controlCheckResponse{
-		Success:     true,
-		FilePath:    task.FilePath,
-		FileExists:  true,
-		FileContent: cleaned,
-	}, nil
+// fileTaskError classifies a filesystem error as a taskError
+func fileTaskError(err error) *taskError {
+	switch {
+	case os.IsNotExist(err):
+		return newTaskError(ErrCodeNotExist, "file does not exist")
+	case os.IsPermission(err):
+		return newTaskError(ErrCodePermission, "%v", err)
+	default:
+		return newTaskError(ErrCodeIO, "%v", err)
+	}
 }
 
-// clearControlFile truncates the control file contents while keeping the file present
+// clearControlFile truncates the control file contents while keeping the file
+// present. The file goes through the same checks as when it was read, so a
+// control file swapped for a symlink or hard link is never truncated.
 func clearControlFile(path string) error {
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	f, _, err := openTaskFile(path, os.O_WRONLY, true)
 	if err != nil {
 		return err
 	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return err
+	}
 	return f.Close()
 }
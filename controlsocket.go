@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// controlSocketFile is the Unix socket in the state directory through which
+// `tally status`, `tally trigger`, `tally pause` and `tally resume` talk to
+// the running daemon. It is only accessible to root.
+const controlSocketFile = "tally.sock"
+
+// maxControlSocketPath is the longest socket path that fits sun_path on every
+// platform (104 bytes on macOS and the BSDs, 108 on Linux, with its NUL)
+const maxControlSocketPath = 103
+
+// Control socket commands
+const (
+	controlStatus  = "status"
+	controlTrigger = "trigger"
+	controlPause   = "pause"
+	controlResume  = "resume"
+)
+
+// controlRequest is one command sent over the control socket, as a single
+// line of JSON
+type controlRequest struct {
+	Command string `json:"command"`
+}
+
+// controlResponse answers a controlRequest, as a single line of JSON
+type controlResponse struct {
+	OK      bool        `json:"ok"`
+	Error   string      `json:"error,omitempty"`
+	Message string      `json:"message,omitempty"`
+	Status  *liveStatus `json:"status,omitempty"`
+}
+
+// liveStatus is the daemon status served over the control socket: the last
+// status snapshot refreshed with live values
+type liveStatus struct {
+	daemonStatus
+	KeyFingerprint string        `json:"key_fingerprint,omitempty"`
+	RecentErrors   []recentError `json:"recent_errors,omitempty"`
+}
+
+// recentError is an error message logged by the daemon
+type recentError struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// recentErrorLimit is how many recent errors the status keeps
+const recentErrorLimit = 10
+
+var (
+	// daemonPaused stops task cycles until resumed; heartbeats continue
+	daemonPaused atomic.Bool
+
+	// cycleTrigger asks the daemon loop to run a task cycle now
+	cycleTrigger = make(chan struct{}, 1)
+
+	recentErrors   []recentError
+	recentErrorsMu sync.Mutex
+)
+
+// recordRecentError keeps a logged error for the status
+func recordRecentError(message string) {
+	recentErrorsMu.Lock()
+	defer recentErrorsMu.Unlock()
+
+	recentErrors = append(recentErrors, recentError{Time: time.Now().UTC(), Message: message})
+	if len(recentErrors) > recentErrorLimit {
+		recentErrors = recentErrors[len(recentErrors)-recentErrorLimit:]
+	}
+}
+
+// controlSocketPath returns the path of the control socket
+func controlSocketPath() string {
+	return statePath(controlSocketFile)
+}
+
+// startControlSocket listens on the control socket until ctx is cancelled.
+// The instance lock is held, so a socket file left behind is stale.
+func startControlSocket(ctx context.Context) error {
+	path := controlSocketPath()
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove stale control socket: %v", err)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return fmt.Errorf("failed to restrict control socket: %v", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.Error("Control socket stopped", "error", err)
+				}
+				return
+			}
+			go serveControlConn(conn)
+		}
+	}()
+	return nil
+}
+
+// serveControlConn answers the commands sent over one connection
+func serveControlConn(conn net.Conn) {
+	defer conn.Close()
+
+	if err := checkControlPeer(conn); err != nil {
+		logger.Error("Refused control socket connection", "error", err)
+		json.NewEncoder(conn).Encode(controlResponse{Error: err.Error()})
+		return
+	}
+
+	scanner := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		conn.SetDeadline(time.Now().Add(time.Minute))
+		if !scanner.Scan() {
+			return
+		}
+		var req controlRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			enc.Encode(controlResponse{Error: "invalid request"})
+			return
+		}
+		if err := enc.Encode(handleControlRequest(req)); err != nil {
+			return
+		}
+	}
+}
+
+// handleControlRequest runs one control command
+func handleControlRequest(req controlRequest) controlResponse {
+	switch req.Command {
+	case controlStatus:
+		status := buildLiveStatus()
+		return controlResponse{OK: true, Status: &status}
+
+	case controlTrigger:
+		if daemonPaused.Load() {
+			return controlResponse{Error: "task cycles are paused; resume first"}
+		}
+		select {
+		case cycleTrigger <- struct{}{}:
+			return controlResponse{OK: true, Message: "task cycle triggered"}
+		default:
+			return controlResponse{OK: true, Message: "a task cycle is already queued"}
+		}
+
+	case controlPause:
+		if daemonPaused.Swap(true) {
+			return controlResponse{OK: true, Message: "task cycles were already paused"}
+		}
+		logger.Info("Task cycles paused through the control socket")
+		return controlResponse{OK: true, Message: "task cycles paused"}
+
+	case controlResume:
+		if !daemonPaused.Swap(false) {
+			return controlResponse{OK: true, Message: "task cycles were not paused"}
+		}
+		logger.Info("Task cycles resumed through the control socket")
+		select {
+		case cycleTrigger <- struct{}{}:
+		default:
+		}
+		return controlResponse{OK: true, Message: "task cycles resumed"}
+	}
+	return controlResponse{Error: fmt.Sprintf("unknown command %q (valid: status, trigger, pause, resume)", req.Command)}
+}
+
+// buildLiveStatus refreshes the last status snapshot with live values
+func buildLiveStatus() liveStatus {
+	status := liveStatus{daemonStatus: currentDaemonStatus()}
+	status.PID = os.Getpid()
+	status.StartedAt = daemonStartedAt()
+	status.Paused = daemonPaused.Load()
+	status.Breaker, status.BreakerOpenUntil = breaker.snapshot()
+	status.OutboxDepth = resultOutbox.depth()
+	status.LastSuccess = lastSuccessfulCycle()
+	status.LastHeartbeat = lastHeartbeat()
+
+	if key, err := getKey(); err == nil {
+		sum := sha256.Sum256([]byte(key))
+		status.KeyFingerprint = "sha256:" + hex.EncodeToString(sum[:8])
+	}
+
+	recentErrorsMu.Lock()
+	status.RecentErrors = append([]recentError(nil), recentErrors...)
+	recentErrorsMu.Unlock()
+	return status
+}
+
+// sendControlCommand sends a command to the running daemon
+func sendControlCommand(command string) (controlResponse, error) {
+	conn, err := net.DialTimeout("unix", controlSocketPath(), 5*time.Second)
+	if err != nil {
+		return controlResponse{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if err := json.NewEncoder(conn).Encode(controlRequest{Command: command}); err != nil {
+		return controlResponse{}, err
+	}
+	var resp controlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return controlResponse{}, fmt.Errorf("invalid response from daemon: %v", err)
+	}
+	if !resp.OK {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// runControlCommand handles `tally trigger|pause|resume`
+func runControlCommand(command string) error {
+	resp, err := sendControlCommand(command)
+	if err != nil {
+		return fmt.Errorf("%s failed: %v", command, err)
+	}
+	fmt.Println(resp.Message)
+	return nil
+}
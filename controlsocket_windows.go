@@ -0,0 +1,12 @@
+//go:build windows
+
+package main
+
+import "net"
+
+// checkControlPeer relies on the state directory's ACL, which only admits
+// SYSTEM and Administrators (see restrictStateDir); Windows does not report
+// the credentials of a Unix socket peer
+func checkControlPeer(conn net.Conn) error {
+	return nil
+}
@@ -2,74 +2,333 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// runDaemon contains the core daemon logic with graceful shutdown support
-func RunDaemon(ctx context.Context) error {
-	LogInfo("Tally Beacon Service Starting...")
+// serverPollInterval holds the poll interval last requested by the
+// scorekeeper via next_poll_seconds, or 0 if it has not asked for one
+var serverPollInterval atomic.Int64
 
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
+// setServerPollInterval records the scorekeeper's requested poll interval
+func setServerPollInterval(seconds int) {
+	if seconds > 0 {
+		serverPollInterval.Store(int64(time.Duration(seconds) * time.Second))
+	} else {
+		serverPollInterval.Store(0)
+	}
+}
 
-	// Run first iteration immediately
-	if err := executeTaskCycle(); err != nil {
-		LogError("Error in task cycle: %v", err)
+// effectivePollInterval returns the configured interval, or the server's
+// requested interval clamped to the configured bounds if it sent one
+func effectivePollInterval() time.Duration {
+	requested := time.Duration(serverPollInterval.Load())
+	if requested <= 0 {
+		return cfg.Interval.Duration()
+	}
+	return min(max(requested, cfg.MinInterval.Duration()), cfg.MaxInterval.Duration())
+}
+
+// jitterDelay spreads d by up to ±cfg.Jitter so that many beacons started
+// together do not hit the scorekeeper in the same second
+func jitterDelay(d time.Duration) time.Duration {
+	if cfg.Jitter <= 0 {
+		return d
+	}
+	spread := float64(d) * cfg.Jitter
+	return d + time.Duration((rand.Float64()*2-1)*spread)
+}
+
+// prepareDaemon sets up the state the daemon runs on: the state directory,
+// interrupted rotations, the key watcher, the path policy, the ledger and the
+// outbox. It runs before the service reports that it has started, so that a
+// problem here fails the service instead of leaving it running idle.
+func prepareDaemon(ctx context.Context) error {
+	logger.Info("Tally Beacon Service Starting...")
+	markDaemonStarted()
+
+	if err := ensureStateDir(); err != nil {
+		logger.Error("Failed to prepare state directory", "path", cfg.StateDir, "error", err)
+		return err
+	}
+	recoverKeyRotation()
+	recoverCertRotation()
+
+	if err := startKeyWatcher(ctx); err != nil {
+		logger.Error("Key file tamper detection disabled", "error", err)
+	}
+
+	if err := initPathPolicy(); err != nil {
+		logger.Error("Failed to load path policy", "path", cfg.PolicyFile, "error", err)
+		return err
+	}
+	if cfg.taskSigningKey == nil {
+		logger.Info("No task_signing_key configured, task list signatures are not verified")
+	}
+
+	l, err := openLedger(statePath("ledger.json"))
+	if err != nil {
+		logger.Error("Failed to open ledger", "error", err)
+		return err
 	}
+	ledger = l
+
+	o, err := openOutbox(statePath("outbox"))
+	if err != nil {
+		logger.Error("Failed to open outbox", "error", err)
+		return err
+	}
+	resultOutbox = o
+	if depth := o.depth(); depth > 0 {
+		logger.Info("Task results waiting in the outbox", "depth", depth)
+	}
+	return nil
+}
+
+// RunDaemon contains the core daemon logic with graceful shutdown support.
+// prepareDaemon must have succeeded first. Once ctx is done no new task cycle
+// or task is started, and RunDaemon returns when the running cycle has
+// finished; work is the context of that in-flight work, which is only
+// cancelled when it takes longer than shutdown_timeout.
+func RunDaemon(ctx, work context.Context) error {
+	if cfg.HeartbeatInterval > 0 {
+		go runHeartbeats(ctx)
+	}
+
+	if err := startControlSocket(ctx); err != nil {
+		logger.Error("Control socket disabled", "error", err)
+	}
+
+	// Run first iteration immediately
+	timer := time.NewTimer(runCycle(ctx, work))
+	defer timer.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
-			LogInfo("Shutdown signal received, stopping gracefully...")
+			logger.Info("Shutdown signal received, stopping gracefully...")
 			return nil
-		case <-ticker.C:
-			if err := executeTaskCycle(); err != nil {
-				LogError("Error in task cycle: %v", err)
-			}
+		case <-timer.C:
+			timer.Reset(runCycle(ctx, work))
+		case <-cycleTrigger:
+			logger.Info("Task cycle triggered through the control socket")
+			timer.Reset(runCycle(ctx, work))
 		}
 	}
 }
 
-// executeTaskCycle performs one iteration of the task processing loop
-func executeTaskCycle() error {
-	tasks, err := getTasks()
-	if err != nil {
-		LogError("Error getting tasks: %v", err)
-		return err
+// runCycle executes one task cycle and returns the delay until the next one.
+// While the circuit breaker is open the cycle is skipped and the next one is
+// pushed back until the breaker is ready to probe the scorekeeper again.
+func runCycle(ctx, work context.Context) time.Duration {
+	var cycleErr error
+	paused := daemonPaused.Load()
+	if paused {
+		logger.Info("Task cycles are paused, skipping task cycle")
+	} else if state, openUntil := breaker.snapshot(); state == breakerOpen && time.Now().Before(openUntil) {
+		logger.Info("Circuit breaker open, skipping task cycle", "breaker", describeBreaker(state, openUntil))
+		cycleErr = errCircuitOpen
+	} else {
+		cycleErr = executeTaskCycle(ctx, work)
+		if work.Err() != nil || errors.Is(cycleErr, context.Canceled) {
+			// Stopping; the interrupted cycle is not recorded
+			return effectivePollInterval()
+		}
+		if cycleErr != nil {
+			logger.Error("Error in task cycle", "error", cycleErr)
+		}
+	}
+	if !paused {
+		recordCycleResult(cycleErr)
+	}
+	if cfg.HeartbeatInterval == 0 {
+		sendHeartbeat(work)
 	}
 
-	topTask, err := getTopTask(tasks)
-	if err != nil {
-		LogInfo("No tasks to execute: %v", err)
+	interval := effectivePollInterval()
+	delay := jitterDelay(interval)
+	breakerState, breakerOpenUntil := breaker.snapshot()
+	if wait := time.Until(breakerOpenUntil); wait > delay {
+		delay = wait
+	}
+	logger.Info("Next task cycle scheduled", "delay", delay.Round(time.Second), "interval", interval)
+
+	status := daemonStatus{
+		PID:                os.Getpid(),
+		StartedAt:          daemonStartedAt(),
+		LastCycle:          time.Now(),
+		Paused:             paused,
+		ConfiguredInterval: cfg.Interval.String(),
+		EffectiveInterval:  interval.String(),
+		Jitter:             cfg.Jitter,
+		NextPoll:           time.Now().Add(delay),
+		Breaker:            breakerState,
+		BreakerOpenUntil:   breakerOpenUntil,
+		OutboxDepth:        resultOutbox.depth(),
+		LastSuccess:        lastSuccessfulCycle(),
+		LastHeartbeat:      lastHeartbeat(),
+	}
+	if requested := time.Duration(serverPollInterval.Load()); requested > 0 {
+		status.ServerInterval = requested.String()
+	}
+	if cycleErr != nil {
+		status.LastCycleError = cycleErr.Error()
+	}
+	if paused {
+		// No cycle ran; keep reporting the last one that did
+		previous := currentDaemonStatus()
+		status.LastCycle, status.LastCycleError = previous.LastCycle, previous.LastCycleError
+	}
+	setDaemonStatus(status)
+	if err := writeDaemonStatus(status); err != nil {
+		logger.Error("Failed to write status file", "error", err)
+	}
+
+	return delay
+}
+
+// executeTaskCycle performs one iteration of the task processing loop,
+// working through the whole queue in priority order. Requests and tasks run
+// under work; once ctx is done no further tasks are fetched or started.
+func executeTaskCycle(ctx, work context.Context) error {
+	// Replay results left from earlier cycles first, so that an acknowledged
+	// key rotation is in place before the next fetch
+	if err := resultOutbox.flush(work); err != nil {
+		if isRetryable(err) || errors.Is(err, errCircuitOpen) {
+			return fmt.Errorf("failed to replay outbox: %v", err)
+		}
+		logger.Error("Error replaying outbox", "error", err)
+	}
+
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
-	// Get the old key before executing the task (important for rotate_key which changes the key)
-	oldKey, err := getKey()
+	keyMu.RLock()
+	tasks, accepted, err := getTasks(work)
+	keyMu.RUnlock()
+	if accepted != nil {
+		// Changing the key slots needs the write lock, see keyMu
+		keyMu.Lock()
+		if err := adoptKey(*accepted); err != nil {
+			logger.Error("Failed to adopt key accepted by the scorekeeper", "key", accepted.slot, "error", err)
+		}
+		keyMu.Unlock()
+	}
 	if err != nil {
-		LogError("Error getting key: %v", err)
+		if work.Err() == nil {
+			logger.Error("Error getting tasks", "endpoint", GetEndpointURL("tasks"), "error", err)
+		}
 		return err
 	}
+	setServerPollInterval(tasks.NextPollSeconds)
 
-	controlResp, keyRotResp, err := executeTask(topTask)
-	if err != nil {
-		LogError("Error executing task: %v", err)
+	refreshPathPolicy()
+
+	queue := skipCompletedTasks(tasks.Tasks)
+	if len(queue) == 0 {
+		logger.Info("No tasks to execute: no tasks found, we are all caught up!")
+		return nil
+	}
+
+	failed := runTaskQueue(ctx, work, queue)
+	if err := work.Err(); err != nil {
 		return err
 	}
+	flushErr := resultOutbox.flush(work)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d task results could not be queued", failed, len(queue))
+	}
+	if flushErr != nil {
+		return fmt.Errorf("task results queued but not submitted: %v", flushErr)
+	}
+	return nil
+}
 
-	if topTask.TaskType == "check_control" {
-		err = submitTaskResult(controlResp, oldKey)
-		if err != nil {
-			LogError("Error submitting check_control response: %v", err)
-			return err
+// runTaskQueue executes tasks in queue order with up to cfg.Workers running
+// at once and queues their results in the outbox. Exclusive tasks such as
+// rotate_key act as a barrier: they wait for every earlier task to finish and
+// run alone, so that every result queued after a new key is submitted with
+// it. It returns the number of tasks whose result could not be queued.
+// Tasks run under work; once ctx is done no further tasks are started.
+func runTaskQueue(ctx, work context.Context, queue []Task) int {
+	var (
+		wg     sync.WaitGroup
+		failed atomic.Int32
+		sem    = make(chan struct{}, cfg.Workers)
+	)
+
+	for _, task := range queue {
+		if ctx.Err() != nil {
+			break
 		}
-	} else if topTask.TaskType == "rotate_key" {
-		err = submitKeyRotationResult(keyRotResp, oldKey)
-		if err != nil {
-			LogError("Error submitting rotate_key response: %v", err)
-			return err
+		if isExclusiveTask(task) {
+			wg.Wait()
+			if err := processTask(work, task); err != nil {
+				failed.Add(1)
+			}
+			continue
 		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(task Task) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := processTask(work, task); err != nil {
+				failed.Add(1)
+			}
+		}(task)
 	}
+	wg.Wait()
+
+	return int(failed.Load())
+}
+
+// processTask executes a single task and queues its result for submission.
+// Errors and panics are contained so that one bad task does not affect the
+// others. A task interrupted by shutdown is not queued, so it runs again
+// when the daemon restarts.
+func processTask(ctx context.Context, task Task) (err error) {
+	log := taskLogger(task)
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+			log.Error("Task panicked", "panic", r)
+		}
+	}()
 
+	// rotate_key replaces the key files, so it must not overlap a request
+	if isExclusiveTask(task) {
+		keyMu.Lock()
+		defer keyMu.Unlock()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	env := runTask(ctx, task)
+	duration := env.FinishedAt.Sub(env.StartedAt)
+	if err := ctx.Err(); err != nil {
+		log.Info("Task interrupted by shutdown", "duration", duration)
+		return err
+	}
+	if reason, failed := env.failed(); failed {
+		log.Error("Task failed", "reason", reason, "duration", duration)
+	} else {
+		log.Info("Task succeeded", "duration", duration)
+	}
+
+	// Journal the result before anything is sent, so that it survives the
+	// scorekeeper being unreachable and the beacon restarting
+	if _, err := resultOutbox.enqueue(task, env); err != nil {
+		log.Error("Failed to queue task result", "error", err)
+		return err
+	}
 	return nil
 }
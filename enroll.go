@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// beaconIDFile holds the beacon ID assigned at enrollment, in the state directory
+const beaconIDFile = "beacon_id"
+
+// enrollRequest exchanges a one-time join token for beacon credentials
+type enrollRequest struct {
+	Token    string    `json:"token"`
+	BeaconID string    `json:"beacon_id"`
+	Host     hostFacts `json:"host"`
+}
+
+// enrollResponse carries the credentials issued by the scorekeeper
+type enrollResponse struct {
+	BeaconID string `json:"beacon_id"`
+	Key      string `json:"key"`
+}
+
+// parseEnrollArgs reads the -token and -force flags of `tally enroll` and
+// returns the remaining arguments for the configuration
+func parseEnrollArgs(args []string) (token string, force bool, rest []string, err error) {
+	for i := 0; i < len(args); i++ {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		switch {
+		case !strings.HasPrefix(args[i], "-"):
+			rest = append(rest, args[i])
+		case name == "token":
+			if !hasValue {
+				if i+1 >= len(args) {
+					return "", false, nil, fmt.Errorf("-token requires a value")
+				}
+				i++
+				value = args[i]
+			}
+			token = value
+		case name == "force" && !hasValue:
+			force = true
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	if token == "" {
+		return "", false, nil, fmt.Errorf("usage: tally enroll --token <join-token> [--force]")
+	}
+	return token, force, rest, nil
+}
+
+// enrollBeacon exchanges a join token for a per-beacon key and beacon ID and
+// installs them. It refuses to replace existing credentials unless force is set.
+func enrollBeacon(ctx context.Context, token string, force bool) error {
+	// A running daemon would report the new key as tampering
+	if err := acquireInstanceLock(); err != nil {
+		return fmt.Errorf("%v; stop it before enrolling", err)
+	}
+
+	store := secretStore()
+	if !store.Writable() {
+		return fmt.Errorf("the %s secret store is read-only; provision the key through it instead of enrolling", store.Name())
+	}
+	if _, err := store.Get(slotActive); err == nil && !force {
+		return fmt.Errorf("beacon is already enrolled (a key is in the %s secret store); use --force to re-enroll", store.Name())
+	}
+	configuredID := cfg.BeaconID != defaultBeaconID(cfg.StateDir)
+
+	payload, err := json.Marshal(enrollRequest{
+		Token:    token,
+		BeaconID: cfg.BeaconID,
+		Host:     collectHostFacts(),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Join tokens are single-use, so the request is not retried: a retry
+	// after a lost response would only be refused
+	req, err := http.NewRequestWithContext(ctx, "POST", GetEndpointURL("enroll"), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	body, _, err := doRequest(req)
+	if err != nil {
+		return fmt.Errorf("enrollment failed: %v", err)
+	}
+
+	var resp enrollResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return fmt.Errorf("invalid enrollment response: %v", err)
+	}
+	resp.BeaconID = strings.TrimSpace(resp.BeaconID)
+	if resp.Key == "" || resp.BeaconID == "" {
+		return fmt.Errorf("invalid enrollment response: key and beacon_id are required")
+	}
+
+	if err := ensureStateDir(); err != nil {
+		return err
+	}
+
+	// Leftovers of a rotation with the old credentials must not be adopted
+	for _, slot := range []keySlot{slotPending, slotPrevious} {
+		if err := store.Delete(slot); err != nil {
+			return fmt.Errorf("failed to remove %s key: %v", slot, err)
+		}
+	}
+
+	if err := store.Put(slotActive, resp.Key); err != nil {
+		return fmt.Errorf("failed to store key: %v", err)
+	}
+	if err := writeOwnedFile(statePath(beaconIDFile), []byte(resp.BeaconID+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write beacon ID: %v", err)
+	}
+
+	fmt.Printf("Enrolled as beacon %s\n", resp.BeaconID)
+	if fs, ok := store.(fileBackedStore); ok {
+		fmt.Printf("Key written to %s\n", fs.path(slotActive))
+	} else {
+		fmt.Printf("Key stored in the %s secret store\n", store.Name())
+	}
+	if configuredID && cfg.BeaconID != resp.BeaconID {
+		fmt.Printf("Note: beacon_id is set to %s in the configuration, which overrides the enrolled ID\n", cfg.BeaconID)
+	}
+	return nil
+}
+
+// writeOwnedFile writes a file atomically and, when running as root, makes
+// it owned by root so that group ownership is not inherited from the directory
+func writeOwnedFile(path string, data []byte, perm os.FileMode) error {
+	if err := writeFileAtomic(path, data, perm); err != nil {
+		return err
+	}
+	if os.Geteuid() == 0 {
+		return os.Lchown(path, 0, 0)
+	}
+	return nil
+}
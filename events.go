@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// eventsEndpoint receives beacon events that are not task results
+const eventsEndpoint = "events"
+
+// beaconEvent is a security-relevant occurrence reported to the scorekeeper,
+// such as a rejected task list
+type beaconEvent struct {
+	Type     string      `json:"type"`
+	BeaconID string      `json:"beacon_id"`
+	Time     time.Time   `json:"time"`
+	Details  interface{} `json:"details,omitempty"`
+}
+
+// reportEvent posts an event to the scorekeeper. Failures are only logged:
+// events are informational and must not hold up the task cycle.
+func reportEvent(ctx context.Context, eventType string, details interface{}) {
+	key, err := getKey()
+	if err != nil {
+		logger.Error("Failed to report event: failed to get authentication key", "event", eventType, "error", err)
+		return
+	}
+	reportEventWithKey(ctx, eventType, details, key)
+}
+
+// reportEventWithKey posts an event authenticated with the given key, for
+// events about the key file itself
+func reportEventWithKey(ctx context.Context, eventType string, details interface{}, key string) {
+	event := beaconEvent{
+		Type:     eventType,
+		BeaconID: cfg.BeaconID,
+		Time:     time.Now().UTC(),
+		Details:  details,
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		logger.Error("Failed to marshal event", "event", eventType, "error", err)
+		return
+	}
+
+	err = withRetry(ctx, "Reporting "+eventType+" event", defaultRetryPolicy(), func() error {
+		_, err := AuthenticatedPostRequestWithPayload(ctx, GetEndpointURL(eventsEndpoint), payload, key)
+		return err
+	})
+	if err != nil {
+		logger.Error("Failed to report event", "event", eventType, "endpoint", GetEndpointURL(eventsEndpoint), "error", err)
+		return
+	}
+	logger.Info("Reported event", "event", eventType)
+}
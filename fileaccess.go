@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+)
+
+// Task files are opened defensively because their paths point into
+// directories the red team controls:
+//
+//   - the final path component is never followed if it is a symlink
+//   - FIFOs and devices are opened non-blocking and then rejected, so they
+//     cannot hang the daemon
+//   - every check runs on the opened descriptor, not on the path, so the file
+//     cannot be swapped between the check and the read
+//   - hard links are rejected, since a link to /etc/shadow is a regular file
+//   - control files may additionally be required to belong to one owner
+//   - reads give up after cfg.FileReadTimeout
+
+// openTaskFile opens a file named by a task and verifies that it is a plain
+// regular file. Failures are returned as a *taskError.
+func openTaskFile(path string, flag int, checkOwner bool) (*os.File, os.FileInfo, error) {
+	f, err := openNoFollow(path, flag)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, fileTaskError(err)
+	}
+
+	if err := checkTaskFileInfo(info, checkOwner); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+// checkTaskFileInfo applies the file type, link and ownership checks
+func checkTaskFileInfo(info os.FileInfo, checkOwner bool) error {
+	if !info.Mode().IsRegular() {
+		return newTaskError(ErrCodeNotRegular, "not a regular file (%s)", info.Mode().Type())
+	}
+
+	if links := fileLinkCount(info); links > 1 {
+		return newTaskError(ErrCodeHardlink, "file has %d hard links", links)
+	}
+
+	if checkOwner && cfg.ControlFileOwner != "" {
+		uid, ok := fileOwnerUID(info)
+		if !ok || uid != cfg.controlFileOwnerUID {
+			return newTaskError(ErrCodeOwner, "file is not owned by %s", cfg.ControlFileOwner)
+		}
+	}
+	return nil
+}
+
+// readTaskFile reads a file named by a task, enforcing the size limit and
+// read timeout. Failures are returned as a *taskError, except that the
+// context's error is returned once ctx is done.
+func readTaskFile(ctx context.Context, path string, checkOwner bool) ([]byte, error) {
+	f, info, err := openTaskFile(path, os.O_RDONLY, checkOwner)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// check file size (1 MB limit)
+	if info.Size() > maxTaskFileSize {
+		return nil, newTaskError(ErrCodeMaxSize, "file too large (over 1MB)")
+	}
+
+	type readResult struct {
+		content []byte
+		err     error
+	}
+	done := make(chan readResult, 1)
+	go func() {
+		content, err := io.ReadAll(io.LimitReader(f, maxTaskFileSize+1))
+		done <- readResult{content, err}
+	}()
+
+	timer := time.NewTimer(cfg.FileReadTimeout.Duration())
+	defer timer.Stop()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, fileTaskError(r.err)
+		}
+		// The file may have grown since it was stat'ed
+		if len(r.content) > maxTaskFileSize {
+			return nil, newTaskError(ErrCodeMaxSize, "file too large (over 1MB)")
+		}
+		return r.content, nil
+	case <-timer.C:
+		return nil, newTaskError(ErrCodeTimeout, "read timed out after %s", cfg.FileReadTimeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// openPathError converts an error from opening path into a task error
+func openPathError(path string, err error) error {
+	return fileTaskError(&os.PathError{Op: "open", Path: path, Err: err})
+}
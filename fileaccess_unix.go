@@ -0,0 +1,159 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxPathSymlinks bounds the root-owned symlinks followed while opening a path
+const maxPathSymlinks = 40
+
+// openNoFollow opens path without following a symlink in the final
+// component and without blocking on FIFOs or devices. The path is walked one
+// directory at a time with O_NOFOLLOW, so that a symlinked directory cannot
+// redirect it: only symlinks owned by root, such as /var -> private/var on
+// macOS, are followed on the way, since only root can have made them. The
+// file opened is therefore the file the path names.
+func openNoFollow(path string, flag int) (*os.File, error) {
+	dirfd := unix.AT_FDCWD
+	if filepath.IsAbs(path) {
+		fd, err := unix.Open("/", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, openPathError(path, err)
+		}
+		dirfd = fd
+	}
+	closeDir := func() {
+		if dirfd != unix.AT_FDCWD {
+			unix.Close(dirfd)
+		}
+	}
+	defer func() { closeDir() }()
+
+	names := splitPathNames(path)
+	if len(names) == 0 {
+		names = []string{"."}
+	}
+	followed := 0
+	for len(names) > 0 {
+		name := names[0]
+		names = names[1:]
+
+		if len(names) == 0 {
+			fd, err := unix.Openat(dirfd, name, flag|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+			if err != nil {
+				// Linux reports ELOOP for a symlink opened with O_NOFOLLOW, the BSDs EMLINK
+				if err == unix.ELOOP || err == unix.EMLINK {
+					return nil, newTaskError(ErrCodeSymlink, "file is a symlink")
+				}
+				return nil, openPathError(path, err)
+			}
+			return os.NewFile(uintptr(fd), path), nil
+		}
+
+		fd, err := unix.Openat(dirfd, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err == nil {
+			closeDir()
+			dirfd = fd
+			continue
+		}
+
+		// A directory component that is a symlink is only followed if root owns it
+		var st unix.Stat_t
+		if unix.Fstatat(dirfd, name, &st, unix.AT_SYMLINK_NOFOLLOW) != nil || st.Mode&unix.S_IFMT != unix.S_IFLNK {
+			return nil, openPathError(path, err)
+		}
+		if st.Uid != 0 {
+			return nil, newTaskError(ErrCodeSymlink, "path contains a symlink not owned by root (%s)", name)
+		}
+		if followed++; followed > maxPathSymlinks {
+			return nil, openPathError(path, unix.ELOOP)
+		}
+		target, err := readlinkAt(dirfd, name)
+		if err != nil {
+			return nil, openPathError(path, err)
+		}
+		if filepath.IsAbs(target) {
+			fd, err := unix.Open("/", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+			if err != nil {
+				return nil, openPathError(path, err)
+			}
+			closeDir()
+			dirfd = fd
+		}
+		names = append(splitPathNames(target), names...)
+	}
+	return nil, openPathError(path, unix.ENOENT)
+}
+
+// splitPathNames splits a path into the names walked by openNoFollow
+func splitPathNames(path string) []string {
+	var names []string
+	for _, name := range strings.Split(path, "/") {
+		if name != "" && name != "." {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// readlinkAt reads the target of a symlink relative to a directory
+func readlinkAt(dirfd int, name string) (string, error) {
+	buf := make([]byte, 4096)
+	n, err := unix.Readlinkat(dirfd, name, buf)
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:n]), nil
+}
+
+// fileLinkCount returns the number of hard links to a file
+func fileLinkCount(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink)
+	}
+	return 1
+}
+
+// fileOwnerUID returns the UID owning a file
+func fileOwnerUID(info os.FileInfo) (int, bool) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int(st.Uid), true
+	}
+	return 0, false
+}
+
+// lookupOwnerUID resolves a user name or numeric UID
+func lookupOwnerUID(owner string) (int, error) {
+	if uid, err := strconv.Atoi(owner); err == nil {
+		return uid, nil
+	}
+
+	u, err := user.Lookup(owner)
+	if err != nil {
+		return 0, fmt.Errorf("unknown user %q: %v", owner, err)
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// fileIdentity returns the owner, group and inode of a file
+func fileIdentity(info os.FileInfo) (uid, gid int, inode uint64) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int(st.Uid), int(st.Gid), uint64(st.Ino)
+	}
+	return 0, 0, 0
+}
+
+// restrictStateDir makes the state directory accessible to its owner only
+func restrictStateDir(dir string) error {
+	return os.Chmod(dir, 0700)
+}
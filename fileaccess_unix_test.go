@@ -0,0 +1,152 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// taskErrorCode returns the code of a *taskError, or "" for other errors
+func taskErrorCode(err error) ErrorCode {
+	var te *taskError
+	if errors.As(err, &te) {
+		return te.Code
+	}
+	return ""
+}
+
+func TestOpenNoFollow(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite := func(path, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustSymlink := func(target, link string, uid int) {
+		t.Helper()
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+		if uid != os.Geteuid() {
+			if err := os.Lchown(link, uid, -1); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	root := os.Geteuid() == 0
+	mustWrite(filepath.Join(dir, "real", "ctrl.txt"), "team1")
+	mustWrite(filepath.Join(dir, "elsewhere", "secret.txt"), "secret")
+	mustSymlink(filepath.Join(dir, "real", "ctrl.txt"), filepath.Join(dir, "file-link"), os.Geteuid())
+	if root {
+		mustSymlink(filepath.Join(dir, "real"), filepath.Join(dir, "root-abs"), 0)
+		mustSymlink("real", filepath.Join(dir, "root-rel"), 0)
+		mustSymlink(filepath.Join(dir, "elsewhere"), filepath.Join(dir, "user-link"), 12345)
+		mustSymlink("loop-b", filepath.Join(dir, "loop-a"), 0)
+		mustSymlink("loop-a", filepath.Join(dir, "loop-b"), 0)
+	} else {
+		mustSymlink(filepath.Join(dir, "elsewhere"), filepath.Join(dir, "user-link"), os.Geteuid())
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		needRoot bool
+		want     string    // content read on success
+		wantCode ErrorCode // task error code on failure
+	}{
+		{name: "regular file", path: "real/ctrl.txt", want: "team1"},
+		{name: "symlink as the file", path: "file-link", wantCode: ErrCodeSymlink},
+		{name: "symlinked directory not owned by root", path: "user-link/secret.txt", wantCode: ErrCodeSymlink},
+		{name: "root-owned absolute symlink", path: "root-abs/ctrl.txt", needRoot: true, want: "team1"},
+		{name: "root-owned relative symlink", path: "root-rel/ctrl.txt", needRoot: true, want: "team1"},
+		{name: "root-owned symlink loop", path: "loop-a/ctrl.txt", needRoot: true, wantCode: ErrCodeIO},
+		{name: "missing file", path: "real/missing.txt", wantCode: ErrCodeNotExist},
+		{name: "missing directory", path: "missing/ctrl.txt", wantCode: ErrCodeNotExist},
+		{name: "file used as a directory", path: "real/ctrl.txt/x", wantCode: ErrCodeIO},
+		{name: "dot segments", path: "real/./ctrl.txt", want: "team1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.needRoot && !root {
+				t.Skip("needs root to create root-owned symlinks")
+			}
+
+			f, err := openNoFollow(filepath.Join(dir, tt.path), os.O_RDONLY)
+			if tt.wantCode != "" {
+				if err == nil {
+					f.Close()
+					t.Fatalf("opened %s, want %s", tt.path, tt.wantCode)
+				}
+				if code := taskErrorCode(err); code != tt.wantCode {
+					t.Fatalf("error = %v (%s), want %s", err, code, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("openNoFollow: %v", err)
+			}
+			defer f.Close()
+			content, err := io.ReadAll(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != tt.want {
+				t.Errorf("content = %q, want %q", content, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenTaskFileRefusesSpecialFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	fifo := filepath.Join(dir, "fifo")
+	if err := unix.Mkfifo(fifo, 0644); err != nil {
+		t.Fatal(err)
+	}
+	regular := filepath.Join(dir, "ctrl.txt")
+	if err := os.WriteFile(regular, []byte("team1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hardlink := filepath.Join(dir, "hardlink.txt")
+	if err := os.Link(regular, hardlink); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		wantCode ErrorCode
+	}{
+		{name: "fifo", path: fifo, wantCode: ErrCodeNotRegular},
+		{name: "device", path: "/dev/null", wantCode: ErrCodeNotRegular},
+		{name: "directory", path: dir, wantCode: ErrCodeNotRegular},
+		{name: "hard link", path: hardlink, wantCode: ErrCodeHardlink},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A FIFO without a writer would block a plain open forever
+			f, _, err := openTaskFile(tt.path, os.O_RDONLY, false)
+			if err == nil {
+				f.Close()
+				t.Fatalf("opened %s, want %s", tt.path, tt.wantCode)
+			}
+			if code := taskErrorCode(err); code != tt.wantCode {
+				t.Fatalf("error = %v (%s), want %s", err, code, tt.wantCode)
+			}
+		})
+	}
+}
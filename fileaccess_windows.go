@@ -0,0 +1,127 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/windows"
+)
+
+// openNoFollow opens path without following a symlink or junction in the
+// file itself or in any directory above it, and refuses anything that is not
+// a file on disk, such as a named pipe or device. Each directory is opened
+// with FILE_FLAG_OPEN_REPARSE_POINT and checked through its handle, which is
+// held without FILE_SHARE_DELETE until the file is open, so that no
+// directory on the way can be replaced by a junction in between.
+func openNoFollow(path string, flag int) (*os.File, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, openPathError(path, err)
+	}
+
+	var access uint32
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		access = windows.GENERIC_READ
+	case os.O_WRONLY:
+		access = windows.GENERIC_WRITE
+	case os.O_RDWR:
+		access = windows.GENERIC_READ | windows.GENERIC_WRITE
+	}
+
+	volume := filepath.VolumeName(abs)
+	dir := volume + `\`
+	names := strings.Split(strings.Trim(abs[len(volume):], `\`), `\`)
+	for _, name := range names[:len(names)-1] {
+		dir = filepath.Join(dir, name)
+		h, info, err := openReparsePoint(dir, windows.FILE_READ_ATTRIBUTES, windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE)
+		if err != nil {
+			return nil, openPathError(path, err)
+		}
+		defer windows.CloseHandle(h)
+		if info.FileAttributes&windows.FILE_ATTRIBUTE_REPARSE_POINT != 0 {
+			return nil, newTaskError(ErrCodeSymlink, "path contains a symlink or junction (%s)", dir)
+		}
+		if info.FileAttributes&windows.FILE_ATTRIBUTE_DIRECTORY == 0 {
+			return nil, openPathError(path, windows.ERROR_PATH_NOT_FOUND)
+		}
+	}
+
+	h, info, err := openReparsePoint(abs, access, windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE)
+	if err != nil {
+		return nil, openPathError(path, err)
+	}
+	if info.FileAttributes&windows.FILE_ATTRIBUTE_REPARSE_POINT != 0 {
+		windows.CloseHandle(h)
+		return nil, newTaskError(ErrCodeSymlink, "file is a symlink or reparse point")
+	}
+	if fileType, err := windows.GetFileType(h); err != nil || fileType != windows.FILE_TYPE_DISK {
+		windows.CloseHandle(h)
+		return nil, newTaskError(ErrCodeNotRegular, "not a file on disk")
+	}
+	return os.NewFile(uintptr(h), path), nil
+}
+
+// openReparsePoint opens path itself rather than what a reparse point in
+// its place refers to, and returns the handle's file information
+func openReparsePoint(path string, access, share uint32) (windows.Handle, windows.ByHandleFileInformation, error) {
+	var info windows.ByHandleFileInformation
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return windows.InvalidHandle, info, err
+	}
+	h, err := windows.CreateFile(p, access, share, nil, windows.OPEN_EXISTING,
+		windows.FILE_FLAG_OPEN_REPARSE_POINT|windows.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return windows.InvalidHandle, info, err
+	}
+	if err := windows.GetFileInformationByHandle(h, &info); err != nil {
+		windows.CloseHandle(h)
+		return windows.InvalidHandle, info, err
+	}
+	return h, info, nil
+}
+
+// fileLinkCount is not available from os.FileInfo on Windows
+func fileLinkCount(info os.FileInfo) uint64 {
+	return 1
+}
+
+// fileOwnerUID is not supported on Windows
+func fileOwnerUID(info os.FileInfo) (int, bool) {
+	return 0, false
+}
+
+// lookupOwnerUID is not supported on Windows
+func lookupOwnerUID(owner string) (int, error) {
+	return 0, fmt.Errorf("control_file_owner is not supported on windows")
+}
+
+// fileIdentity is not available from os.FileInfo on Windows
+func fileIdentity(info os.FileInfo) (uid, gid int, inode uint64) {
+	return 0, 0, 0
+}
+
+// stateDirSDDL grants full access to SYSTEM and Administrators only, and
+// stops the directory inheriting the more permissive ACL of its parent
+const stateDirSDDL = "D:P(A;OICI;FA;;;SY)(A;OICI;FA;;;BA)"
+
+// restrictStateDir limits the state directory, and with it the control
+// socket, to SYSTEM and Administrators. Windows ignores the Unix permission
+// bits, so without this any local user could use the control socket.
+func restrictStateDir(dir string) error {
+	sd, err := windows.SecurityDescriptorFromString(stateDirSDDL)
+	if err != nil {
+		return err
+	}
+	dacl, _, err := sd.DACL()
+	if err != nil {
+		return err
+	}
+	return windows.SetNamedSecurityInfo(dir, windows.SE_FILE_OBJECT,
+		windows.DACL_SECURITY_INFORMATION|windows.PROTECTED_DACL_SECURITY_INFORMATION, nil, nil, dacl, nil)
+}
@@ -5,6 +5,8 @@ go 1.23.0
 toolchain go1.24.10
 
 require (
-	github.com/kardianos/service v1.2.4 // indirect
-	golang.org/x/sys v0.34.0 // indirect
+	github.com/kardianos/service v1.2.4
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require golang.org/x/sys v0.34.0
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// TaskHandler executes one type of task. Each task type lives in its own
+// file and registers its handler from an init function.
+type TaskHandler interface {
+	// Type returns the task type handled, as sent by the scorekeeper
+	Type() string
+
+	// Validate checks the task's parameters before it is run
+	Validate(task Task) error
+
+	// Run executes the task and returns its result. Failures should be
+	// returned as a *taskError so that they carry an error code; a result
+	// returned alongside the error is still reported as the payload. ctx
+	// carries the task's deadline and is cancelled when the daemon stops.
+	Run(ctx context.Context, task Task) (TaskResult, error)
+}
+
+// TaskResult is the outcome of a task, ready to be submitted
+type TaskResult interface {
+	// Endpoint returns the scorekeeper API path the result is submitted to
+	Endpoint() string
+
+	// Acknowledged is called once the scorekeeper has accepted the result
+	Acknowledged(ctx context.Context) error
+}
+
+// responseAcknowledger is implemented by results whose follow-up work needs
+// the scorekeeper's response to the submission, such as a signed certificate.
+// It is called instead of Acknowledged.
+type responseAcknowledger interface {
+	AcknowledgedWithResponse(ctx context.Context, response []byte) error
+}
+
+// exclusiveHandler is implemented by handlers whose tasks must not run
+// alongside any other task or authenticated request
+type exclusiveHandler interface {
+	Exclusive() bool
+}
+
+// resumableHandler is implemented by handlers whose tasks must not be
+// repeated, or whose results have follow-up work. Resume rebuilds the result
+// recorded in the outbox so that it can be resubmitted, or reports false if
+// the task has to run again.
+type resumableHandler interface {
+	Resume(task Task, recorded json.RawMessage) (TaskResult, bool)
+}
+
+// taskHandlers maps task types to their registered handlers
+var taskHandlers = map[string]TaskHandler{}
+
+// registerTaskHandler makes a handler available to the task dispatcher
+func registerTaskHandler(h TaskHandler) {
+	if _, exists := taskHandlers[h.Type()]; exists {
+		panic(fmt.Sprintf("task handler for %q registered twice", h.Type()))
+	}
+	taskHandlers[h.Type()] = h
+}
+
+// lookupTaskHandler returns the handler for a task type
+func lookupTaskHandler(taskType string) (TaskHandler, bool) {
+	h, ok := taskHandlers[taskType]
+	return h, ok
+}
+
+// registeredTaskTypes lists the task types this beacon can execute
+func registeredTaskTypes() []string {
+	types := make([]string, 0, len(taskHandlers))
+	for taskType := range taskHandlers {
+		types = append(types, taskType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// isExclusiveTask reports whether a task must run on its own
+func isExclusiveTask(task Task) bool {
+	h, ok := lookupTaskHandler(task.TaskType)
+	if !ok {
+		return false
+	}
+	e, ok := h.(exclusiveHandler)
+	return ok && e.Exclusive()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// heartbeatEndpoint receives a liveness report from every beacon, whether or
+// not it had tasks to run
+const heartbeatEndpoint = "heartbeat"
+
+// heartbeat tells the scorekeeper that the beacon is alive and how it is doing
+type heartbeat struct {
+	BeaconID            string     `json:"beacon_id"`
+	Version             string     `json:"version"`
+	StartedAt           time.Time  `json:"started_at"`
+	UptimeSeconds       int64      `json:"uptime_seconds"`
+	LastSuccessfulCycle *time.Time `json:"last_successful_cycle,omitempty"`
+	LastCycleError      string     `json:"last_cycle_error,omitempty"`
+	OutboxDepth         int        `json:"outbox_depth"`
+	Paused              bool       `json:"paused,omitempty"`
+	Breaker             string     `json:"breaker"`
+	Clock               time.Time  `json:"clock"`
+	Host                hostFacts  `json:"host"`
+}
+
+// daemonHealth tracks what the heartbeat reports about the task cycles
+var daemonHealth struct {
+	mu                  sync.Mutex
+	startedAt           time.Time
+	lastSuccessfulCycle time.Time
+	lastCycleError      string
+	lastHeartbeat       time.Time
+}
+
+// heartbeatProbeInterval is how long the beacon stops sending heartbeats
+// after the scorekeeper answered 404, before it tries again
+const heartbeatProbeInterval = 15 * time.Minute
+
+// heartbeatSuspendedUntil is the time (Unix nanoseconds) until which no
+// heartbeats are sent, so that a scorekeeper without the endpoint is not sent
+// one every cycle but is still found once it is upgraded
+var heartbeatSuspendedUntil atomic.Int64
+
+// markDaemonStarted records the daemon start time for the uptime
+func markDaemonStarted() {
+	daemonHealth.mu.Lock()
+	daemonHealth.startedAt = time.Now()
+	daemonHealth.mu.Unlock()
+}
+
+// recordCycleResult records the outcome of a task cycle
+func recordCycleResult(err error) {
+	daemonHealth.mu.Lock()
+	defer daemonHealth.mu.Unlock()
+	if err != nil {
+		daemonHealth.lastCycleError = err.Error()
+		return
+	}
+	daemonHealth.lastSuccessfulCycle = time.Now()
+	daemonHealth.lastCycleError = ""
+}
+
+// daemonStartedAt returns when the daemon started
+func daemonStartedAt() time.Time {
+	daemonHealth.mu.Lock()
+	defer daemonHealth.mu.Unlock()
+	return daemonHealth.startedAt
+}
+
+// lastHeartbeat returns when a heartbeat was last accepted
+func lastHeartbeat() time.Time {
+	daemonHealth.mu.Lock()
+	defer daemonHealth.mu.Unlock()
+	return daemonHealth.lastHeartbeat
+}
+
+// lastSuccessfulCycle returns when a task cycle last completed without error
+func lastSuccessfulCycle() time.Time {
+	daemonHealth.mu.Lock()
+	defer daemonHealth.mu.Unlock()
+	return daemonHealth.lastSuccessfulCycle
+}
+
+// buildHeartbeat collects the current heartbeat
+func buildHeartbeat() heartbeat {
+	breakerState, _ := breaker.snapshot()
+	now := time.Now()
+	hb := heartbeat{
+		BeaconID:    cfg.BeaconID,
+		Version:     Version,
+		OutboxDepth: resultOutbox.depth(),
+		Paused:      daemonPaused.Load(),
+		Breaker:     breakerState,
+		Clock:       now.UTC(),
+		Host:        collectHostFacts(),
+	}
+
+	daemonHealth.mu.Lock()
+	defer daemonHealth.mu.Unlock()
+
+	hb.StartedAt = daemonHealth.startedAt.UTC()
+	hb.UptimeSeconds = int64(now.Sub(daemonHealth.startedAt).Seconds())
+	hb.LastCycleError = daemonHealth.lastCycleError
+	if !daemonHealth.lastSuccessfulCycle.IsZero() {
+		last := daemonHealth.lastSuccessfulCycle.UTC()
+		hb.LastSuccessfulCycle = &last
+	}
+	return hb
+}
+
+// sendHeartbeat posts a heartbeat to the scorekeeper. Like events, failures
+// are only logged. A heartbeat is not retried: the next one is never far off.
+func sendHeartbeat(ctx context.Context) {
+	if time.Now().UnixNano() < heartbeatSuspendedUntil.Load() {
+		return
+	}
+
+	payload, err := json.Marshal(buildHeartbeat())
+	if err != nil {
+		logger.Error("Failed to marshal heartbeat", "error", err)
+		return
+	}
+
+	keyMu.RLock()
+	defer keyMu.RUnlock()
+
+	key, err := getKey()
+	if err != nil {
+		logger.Error("Failed to send heartbeat: failed to get authentication key", "error", err)
+		return
+	}
+
+	err = withRetry(ctx, "Heartbeat", retryPolicy{MaxAttempts: 1}, func() error {
+		_, err := AuthenticatedPostRequestWithPayload(ctx, GetEndpointURL(heartbeatEndpoint), payload, key)
+		return err
+	})
+	if httpStatusCode(err) == http.StatusNotFound {
+		heartbeatSuspendedUntil.Store(time.Now().Add(heartbeatProbeInterval).UnixNano())
+		logger.Info("Scorekeeper does not accept heartbeats, pausing them", "retry_in", heartbeatProbeInterval)
+		return
+	}
+	if errors.Is(err, errCircuitOpen) || ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to send heartbeat", "endpoint", GetEndpointURL(heartbeatEndpoint), "error", err)
+		return
+	}
+
+	daemonHealth.mu.Lock()
+	daemonHealth.lastHeartbeat = time.Now()
+	daemonHealth.mu.Unlock()
+}
+
+// runHeartbeats sends a heartbeat every heartbeat_interval until ctx is
+// cancelled. Without an interval, runCycle sends one with every task cycle.
+func runHeartbeats(ctx context.Context) {
+	ticker := time.NewTicker(cfg.HeartbeatInterval.Duration())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sendHeartbeat(ctx)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatProbesAgainAfter404(t *testing.T) {
+	status := http.StatusNotFound
+	o, server := newTestOutbox(t, func(w http.ResponseWriter, body string) {
+		w.WriteHeader(status)
+	})
+	oldOutbox := resultOutbox
+	resultOutbox = o
+	t.Cleanup(func() {
+		resultOutbox = oldOutbox
+		heartbeatSuspendedUntil.Store(0)
+	})
+	heartbeatSuspendedUntil.Store(0)
+
+	sendHeartbeat(context.Background())
+	sendHeartbeat(context.Background())
+	if n := server.submissions.Load(); n != 1 {
+		t.Fatalf("heartbeats sent = %d, want 1 before pausing after the 404", n)
+	}
+
+	status = http.StatusOK
+	heartbeatSuspendedUntil.Store(time.Now().Add(-time.Second).UnixNano())
+	sent := time.Now()
+	sendHeartbeat(context.Background())
+	if n := server.submissions.Load(); n != 2 {
+		t.Fatalf("heartbeats sent = %d, want 2 once heartbeatProbeInterval has passed", n)
+	}
+	if lastHeartbeat().Before(sent) {
+		t.Error("accepted heartbeat not recorded")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// hostFacts describes the machine the beacon runs on
+type hostFacts struct {
+	Hostname  string   `json:"hostname"`
+	OS        string   `json:"os"`
+	Arch      string   `json:"arch"`
+	OSRelease string   `json:"os_release,omitempty"`
+	Kernel    string   `json:"kernel,omitempty"`
+	MachineID string   `json:"machine_id,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+	MACs      []string `json:"macs,omitempty"`
+	Version   string   `json:"version"`
+	GoVersion string   `json:"go_version"`
+	BuildDate string   `json:"build_date"`
+	NumCPU    int      `json:"num_cpu"`
+	Container bool     `json:"container,omitempty"`
+}
+
+// collectHostFacts gathers host facts; anything unavailable is left empty
+func collectHostFacts() hostFacts {
+	hostname, _ := os.Hostname()
+	facts := hostFacts{
+		Hostname:  hostname,
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Version:   Version,
+		GoVersion: runtime.Version(),
+		BuildDate: BuildDate,
+		NumCPU:    runtime.NumCPU(),
+	}
+
+	if runtime.GOOS == "linux" {
+		facts.OSRelease = osReleaseName()
+		facts.Kernel = readTrimmed("/proc/sys/kernel/osrelease")
+		facts.MachineID = readTrimmed("/etc/machine-id")
+		_, err := os.Stat("/.dockerenv")
+		facts.Container = err == nil
+	}
+
+	interfaces, _ := net.Interfaces()
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		if mac := iface.HardwareAddr.String(); mac != "" {
+			facts.MACs = append(facts.MACs, mac)
+		}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLinkLocalUnicast() {
+				facts.Addresses = append(facts.Addresses, ipnet.IP.String())
+			}
+		}
+	}
+	return facts
+}
+
+// osReleaseName returns PRETTY_NAME from /etc/os-release
+func osReleaseName() string {
+	data, err := os.ReadFile("/etc/os-release")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "PRETTY_NAME="); ok {
+			return strings.Trim(value, `"'`)
+		}
+	}
+	return ""
+}
+
+// readTrimmed returns the trimmed contents of a small file, or ""
+func readTrimmed(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
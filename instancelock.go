@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// instanceLockFile is locked by the running beacon for its whole lifetime,
+// so that two copies never claim the same control files or rotate the key
+// at once. It holds the PID of the process holding the lock.
+const instanceLockFile = "tally.lock"
+
+// errLockHeld is returned by lockFile when another process holds the lock
+var errLockHeld = errors.New("lock is held by another process")
+
+// instanceLock is the open lock file; closing it or exiting releases the lock
+var instanceLock *os.File
+
+// instanceLockedError names the process that holds the instance lock
+type instanceLockedError struct {
+	PID  int
+	Path string
+}
+
+func (e *instanceLockedError) Error() string {
+	if e.PID > 0 {
+		return fmt.Sprintf("another tally instance is already running (PID %d holds %s)", e.PID, e.Path)
+	}
+	return fmt.Sprintf("another tally instance is already running (it holds %s)", e.Path)
+}
+
+// acquireInstanceLock takes the instance lock for the rest of the process
+// lifetime, or reports which process holds it
+func acquireInstanceLock() error {
+	if instanceLock != nil {
+		return nil
+	}
+	if err := ensureStateDir(); err != nil {
+		return err
+	}
+
+	path := statePath(instanceLockFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open lock file: %v", err)
+	}
+	if err := lockFile(f); err != nil {
+		pid := readLockPID(f)
+		f.Close()
+		if errors.Is(err, errLockHeld) {
+			return &instanceLockedError{PID: pid, Path: path}
+		}
+		return fmt.Errorf("failed to lock %s: %v", path, err)
+	}
+
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write lock file: %v", err)
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write lock file: %v", err)
+	}
+	instanceLock = f
+	return nil
+}
+
+// instanceLockHolder reports whether another process holds the instance
+// lock, and its PID
+func instanceLockHolder() (pid int, held bool, err error) {
+	f, err := os.Open(statePath(instanceLockFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+
+	err = lockFile(f)
+	if err == nil {
+		unlockFile(f)
+		return 0, false, nil
+	}
+	if errors.Is(err, errLockHeld) {
+		return readLockPID(f), true, nil
+	}
+	return 0, false, err
+}
+
+// readLockPID reads the PID recorded in the lock file, or 0
+func readLockPID(f *os.File) int {
+	data, err := io.ReadAll(io.NewSectionReader(f, 0, 32))
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return pid
+}
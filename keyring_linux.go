@@ -0,0 +1,91 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// keyringStore keeps the key in the Linux kernel keyring of the beacon's
+// user, as "user" keys named <secret_name>:<slot>. The keys never touch the
+// disk, so they do not survive a reboot.
+type keyringStore struct {
+	prefix string
+}
+
+// keyringPerm lets the possessor and the owning user (root) use the key
+const keyringPerm = 0x3f3f0000
+
+func newKeyringStore(prefix string) (SecretStore, error) {
+	return keyringStore{prefix: prefix}, nil
+}
+
+func (s keyringStore) Name() string {
+	return secretStoreKeyring
+}
+
+func (s keyringStore) Writable() bool {
+	return true
+}
+
+func (s keyringStore) description(slot keySlot) string {
+	return s.prefix + ":" + string(slot)
+}
+
+// find returns the ID of the key for slot
+func (s keyringStore) find(slot keySlot) (int, error) {
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, "user", s.description(slot), 0)
+	if errors.Is(err, unix.ENOKEY) || errors.Is(err, unix.EKEYREVOKED) || errors.Is(err, unix.EKEYEXPIRED) {
+		return 0, fmt.Errorf("%w: %s", errSecretNotFound, s.description(slot))
+	}
+	if err != nil {
+		return 0, fmt.Errorf("keyring search failed: %v", err)
+	}
+	return id, nil
+}
+
+func (s keyringStore) Get(slot keySlot) (string, error) {
+	id, err := s.find(slot)
+	if err != nil {
+		return "", err
+	}
+	size, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to read key from keyring: %v", err)
+	}
+	buf := make([]byte, size)
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, buf, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to read key from keyring: %v", err)
+	}
+	return string(buf[:min(n, size)]), nil
+}
+
+func (s keyringStore) Put(slot keySlot, value string) error {
+	// Adding a key with an existing description updates it in place
+	id, err := unix.AddKey("user", s.description(slot), []byte(value), unix.KEY_SPEC_USER_KEYRING)
+	if err != nil {
+		return fmt.Errorf("failed to add key to keyring: %v", err)
+	}
+	if err := unix.KeyctlSetperm(id, keyringPerm); err != nil {
+		return fmt.Errorf("failed to set keyring permissions: %v", err)
+	}
+	return nil
+}
+
+func (s keyringStore) Delete(slot keySlot) error {
+	id, err := s.find(slot)
+	if errors.Is(err, errSecretNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := unix.KeyctlInt(unix.KEYCTL_INVALIDATE, id, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to remove key from keyring: %v", err)
+	}
+	return nil
+}
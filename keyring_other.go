@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+func newKeyringStore(prefix string) (SecretStore, error) {
+	return nil, fmt.Errorf("the keyring secret store is only available on Linux")
+}
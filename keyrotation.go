@@ -1,11 +1,104 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 )
 
+// Key rotation is two-phase so that the beacon never holds a key the
+// scorekeeper has not seen:
+//
+//  1. rotateKey stores the new key in the pending slot of the secret store;
+//     the active key is untouched.
+//  2. The result is submitted with the current key.
+//  3. Once the scorekeeper acks, commitKeyRotation copies the current key to
+//     the previous slot and the pending key to the active slot.
+//
+// If the beacon is interrupted between the steps, or cannot tell whether the
+// scorekeeper applied the rotation, a 401 on the task fetch makes it retry
+// with the pending key and then with the previous key (within the grace
+// window), adopting whichever one the scorekeeper accepts.
+
+func init() {
+	registerTaskHandler(rotateKeyHandler{})
+}
+
+// rotateKeyHandler replaces the beacon's API key
+type rotateKeyHandler struct{}
+
+func (rotateKeyHandler) Type() string {
+	return "rotate_key"
+}
+
+func (rotateKeyHandler) Validate(task Task) error {
+	if !secretStore().Writable() {
+		return fmt.Errorf("the %s secret store is read-only; rotate the key where it is provisioned", secretStore().Name())
+	}
+	return nil
+}
+
+func (rotateKeyHandler) Run(ctx context.Context, task Task) (TaskResult, error) {
+	resp, err := rotateKey(task)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Exclusive keeps rotation from overlapping any other authenticated request
+func (rotateKeyHandler) Exclusive() bool {
+	return true
+}
+
+// Resume resubmits the recorded key only while it is still staged; otherwise
+// the scorekeeper kept the old key and a fresh rotation is safe
+func (rotateKeyHandler) Resume(task Task, recorded json.RawMessage) (TaskResult, bool) {
+	var resp keyRotationResponse
+	if err := json.Unmarshal(recorded, &resp); err != nil {
+		return nil, false
+	}
+	if !isPendingKey(resp.NewKey) {
+		return nil, false
+	}
+	return resp, true
+}
+
+// Endpoint implements TaskResult
+func (r keyRotationResponse) Endpoint() string {
+	return "rotate_key"
+}
+
+// Acknowledged activates the new key once the scorekeeper has recorded it
+func (r keyRotationResponse) Acknowledged(ctx context.Context) error {
+	if err := commitKeyRotation(); err != nil {
+		return fmt.Errorf("failed to activate the new key: %v", err)
+	}
+	return nil
+}
+
+// keyMu serializes key rotation with every other authenticated call: requests
+// hold the read lock; rotate_key, and anything else that changes the key
+// slots, holds the write lock. rotate_key holds it from generating the new
+// key until the rotation is committed.
+var keyMu sync.RWMutex
+
+// pendingKeyPath returns the path of the not-yet-acknowledged key
+func pendingKeyPath(keyfilePath string) string {
+	return keyfilePath + ".pending"
+}
+
+// previousKeyPath returns the path of the key that was replaced by the last rotation
+func previousKeyPath(keyfilePath string) string {
+	return keyfilePath + ".prev"
+}
+
 // generateNewKey creates a random 32-character API key using readable characters
 func generateNewKey() (string, error) {
 	const charset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
@@ -24,59 +117,180 @@ func generateNewKey() (string, error) {
 	return string(key), nil
 }
 
-// rotateKey generates a new API key and writes it to the platform-specific key file
+// rotateKey generates a new API key and stages it as the pending key. The
+// active key is only replaced by commitKeyRotation once the scorekeeper acks.
 func rotateKey(task Task) (keyRotationResponse, error) {
-	var keyfilePath string
-
-	// Determine key file path based on operating system
-	keyfilePath, err := GetKeyFilePath()
+	newKey, err := generateNewKey()
 	if err != nil {
-		return keyRotationResponse{
-			Success:       false,
-			RotationError: fmt.Sprintf("failed to get key file path: %v", err),
-		}, nil
+		return keyRotationResponse{}, newTaskError(ErrCodeKeyRotation, "failed to generate new key: %v", err)
 	}
 
-	newKey, err := generateNewKey()
-	if err != nil {
-		return keyRotationResponse{
-			Success:       false,
-			RotationError: fmt.Sprintf("failed to generate new key: %v", err),
-		}, nil
+	if err := secretStore().Put(slotPending, newKey); err != nil {
+		return keyRotationResponse{}, newTaskError(ErrCodeKeyRotation, "failed to stage pending key in the %s secret store: %v", secretStore().Name(), err)
 	}
 
-	// Write key with restricted permissions (0600 = read/write for owner only)
-	_, err = os.Stat(keyfilePath)
+	return keyRotationResponse{NewKey: newKey}, nil
+}
+
+// commitKeyRotation promotes the pending key to the active key, keeping the
+// replaced key as the previous key for the grace window
+func commitKeyRotation() error {
+	defer expectKeyFileChange()()
+
+	store := secretStore()
+	pending, err := store.Get(slotPending)
 	if err != nil {
-		return keyRotationResponse{
-			Success:       false,
-			RotationError: fmt.Sprintf("error checking if key file exists: %v", err),
-		}, nil
-	}
-
-	if os.IsNotExist(err) {
-		// Create the file if it does not exist
-		emptyFile, err := os.Create(keyfilePath)
-		os.Chmod(keyfilePath, 0600)
-		if err != nil {
-			return keyRotationResponse{
-				Success:       false,
-				RotationError: fmt.Sprintf("failed to create key file: %v", err),
-			}, nil
+		return fmt.Errorf("no pending key to commit: %v", err)
+	}
+
+	current, err := store.Get(slotActive)
+	if err != nil && !errors.Is(err, errSecretNotFound) {
+		return fmt.Errorf("failed to read current key: %v", err)
+	}
+	if err == nil {
+		if err := store.Put(slotPrevious, current); err != nil {
+			return fmt.Errorf("failed to save previous key: %v", err)
 		}
-		emptyFile.Close()
+		if err := writeFileAtomic(statePath(previousKeyTimeFile), []byte(time.Now().UTC().Format(time.RFC3339)), 0600); err != nil {
+			logger.Error("Failed to record key rotation time", "error", err)
+		}
+	}
+
+	if err := store.Put(slotActive, pending); err != nil {
+		return fmt.Errorf("failed to activate pending key: %v", err)
 	}
+	return store.Delete(slotPending)
+}
+
+// rollbackKeyRotation restores the previous key as the active key
+func rollbackKeyRotation() error {
+	defer expectKeyFileChange()()
 
-	err = os.WriteFile(keyfilePath, []byte(newKey), 0600)
+	store := secretStore()
+	previous, err := store.Get(slotPrevious)
 	if err != nil {
-		return keyRotationResponse{
-			Success:       false,
-			RotationError: fmt.Sprintf("failed to write key to file: %v", err),
-		}, nil
+		return fmt.Errorf("failed to restore previous key: %v", err)
+	}
+	if err := store.Put(slotActive, previous); err != nil {
+		return fmt.Errorf("failed to restore previous key: %v", err)
+	}
+	return store.Delete(slotPrevious)
+}
+
+// discardPendingKey removes a pending key the scorekeeper never adopted
+func discardPendingKey() {
+	store := secretStore()
+	if _, err := store.Get(slotPending); err != nil {
+		return
+	}
+	if err := store.Delete(slotPending); err == nil {
+		logger.Info("Current key accepted by scorekeeper, discarded stale pending key")
 	}
+}
+
+// isPendingKey reports whether key is the currently staged pending key
+func isPendingKey(key string) bool {
+	pending, err := secretStore().Get(slotPending)
+	return err == nil && key != "" && pending == key
+}
+
+// previousKeyTimeFile records when the previous key was replaced, in the
+// state directory, to bound its grace window
+const previousKeyTimeFile = "previous_key_time"
+
+// previousKeyExpired reports whether the previous key is past its grace
+// window. Without a recorded rotation time it is treated as expired.
+func previousKeyExpired() bool {
+	rotated, err := time.Parse(time.RFC3339, readTrimmed(statePath(previousKeyTimeFile)))
+	return err != nil || time.Since(rotated) >= cfg.KeyGracePeriod.Duration()
+}
+
+// slotKey is a key as read from one slot of the secret store
+type slotKey struct {
+	slot keySlot
+	key  string
+}
 
-	return keyRotationResponse{
-		Success: true,
-		NewKey:  newKey,
-	}, nil
+// fallbackKeys returns the keys to try, in order, after the scorekeeper
+// rejects the active key: the pending key of an unfinished rotation, then
+// the previous key while it is within the grace window
+func fallbackKeys() []slotKey {
+	store := secretStore()
+
+	var keys []slotKey
+	if pending, err := store.Get(slotPending); err == nil {
+		keys = append(keys, slotKey{slot: slotPending, key: pending})
+	}
+	if !previousKeyExpired() {
+		if previous, err := store.Get(slotPrevious); err == nil {
+			keys = append(keys, slotKey{slot: slotPrevious, key: previous})
+		}
+	}
+	return keys
+}
+
+// adoptKey settles the key slots once the scorekeeper has accepted a key:
+// an accepted pending key completes the rotation, an accepted previous key
+// rolls it back and an accepted active key makes a pending key obsolete.
+// The caller must hold keyMu exclusively. The slots may have changed since
+// the key was read, so nothing is done unless the slot still holds it.
+func adoptKey(accepted slotKey) error {
+	if current, err := secretStore().Get(accepted.slot); err != nil || current != accepted.key {
+		logger.Info("Key slots changed since the key was accepted, leaving them as they are", "key", accepted.slot)
+		return nil
+	}
+
+	switch accepted.slot {
+	case slotPending:
+		return commitKeyRotation()
+	case slotPrevious:
+		return rollbackKeyRotation()
+	default:
+		discardPendingKey()
+		return nil
+	}
+}
+
+// recoverKeyRotation cleans up after a rotation that was interrupted by a
+// crash or restart. It runs once at daemon startup.
+func recoverKeyRotation() {
+	store := secretStore()
+
+	if fs, ok := store.(*fileStore); ok {
+		// Temporary files left behind by an interrupted atomic write
+		for _, slot := range []keySlot{slotActive, slotPending, slotPrevious} {
+			path := fs.path(slot)
+			matches, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*"))
+			for _, match := range matches {
+				os.Remove(match)
+			}
+		}
+		fs.encryptPlaintext()
+	}
+
+	if !store.Writable() {
+		return
+	}
+
+	if pending, err := store.Get(slotPending); err == nil {
+		active, err := store.Get(slotActive)
+		switch {
+		case errors.Is(err, errSecretNotFound):
+			logger.Info("No active key but a pending key exists, activating pending key")
+			if err := store.Put(slotActive, pending); err != nil {
+				logger.Error("Failed to activate pending key", "error", err)
+			} else {
+				store.Delete(slotPending)
+			}
+		case err == nil && active == pending:
+			// Interrupted after the pending key was activated
+			store.Delete(slotPending)
+		default:
+			logger.Info("Found unfinished key rotation, it will be resolved on the next authenticated request")
+		}
+	}
+
+	if previousKeyExpired() {
+		store.Delete(slotPrevious)
+	}
 }
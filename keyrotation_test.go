@@ -0,0 +1,277 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestKeyStore installs a file secret store holding slots in a fresh
+// state directory. A non-zero rotatedAgo records the last rotation that
+// long ago, starting the previous key's grace window.
+func newTestKeyStore(t *testing.T, slots map[keySlot]string, rotatedAgo time.Duration) *fileStore {
+	t.Helper()
+
+	dir := t.TempDir()
+	store := &fileStore{keyFile: filepath.Join(dir, "tally.key")}
+	c := defaultConfig()
+	c.StateDir = dir
+	c.KeyFile = store.keyFile
+	c.KeyGracePeriod = Duration(10 * time.Minute)
+	c.secretStore = store
+	withConfig(t, c)
+
+	for slot, key := range slots {
+		if err := store.Put(slot, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rotatedAgo != 0 {
+		rotated := time.Now().Add(-rotatedAgo).UTC().Format(time.RFC3339)
+		if err := writeFileAtomic(statePath(previousKeyTimeFile), []byte(rotated), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+// keySlots returns the keys held by store, by slot
+func keySlots(t *testing.T, store SecretStore) map[keySlot]string {
+	t.Helper()
+	slots := map[keySlot]string{}
+	for _, slot := range []keySlot{slotActive, slotPending, slotPrevious} {
+		if key, err := store.Get(slot); err == nil {
+			slots[slot] = key
+		}
+	}
+	return slots
+}
+
+func TestCommitKeyRotation(t *testing.T) {
+	tests := []struct {
+		name     string
+		slots    map[keySlot]string
+		want     map[keySlot]string
+		wantErr  bool
+		wantTime bool // the rotation time is recorded
+	}{
+		{
+			name:     "replaces the active key",
+			slots:    map[keySlot]string{slotActive: "old", slotPending: "new"},
+			want:     map[keySlot]string{slotActive: "new", slotPrevious: "old"},
+			wantTime: true,
+		},
+		{
+			name:  "without an active key",
+			slots: map[keySlot]string{slotPending: "new"},
+			want:  map[keySlot]string{slotActive: "new"},
+		},
+		{
+			name:    "without a pending key",
+			slots:   map[keySlot]string{slotActive: "old"},
+			want:    map[keySlot]string{slotActive: "old"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestKeyStore(t, tt.slots, 0)
+
+			err := commitKeyRotation()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("commitKeyRotation error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := keySlots(t, store); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("slots = %v, want %v", got, tt.want)
+			}
+			_, statErr := os.Stat(statePath(previousKeyTimeFile))
+			if recorded := statErr == nil; recorded != tt.wantTime {
+				t.Errorf("rotation time recorded = %v, want %v", recorded, tt.wantTime)
+			}
+			if tt.wantTime && previousKeyExpired() {
+				t.Error("previous key expired right after the rotation")
+			}
+		})
+	}
+}
+
+func TestRollbackKeyRotation(t *testing.T) {
+	tests := []struct {
+		name    string
+		slots   map[keySlot]string
+		want    map[keySlot]string
+		wantErr bool
+	}{
+		{
+			name:  "restores the previous key",
+			slots: map[keySlot]string{slotActive: "new", slotPrevious: "old"},
+			want:  map[keySlot]string{slotActive: "old"},
+		},
+		{
+			name:    "without a previous key",
+			slots:   map[keySlot]string{slotActive: "new"},
+			want:    map[keySlot]string{slotActive: "new"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestKeyStore(t, tt.slots, time.Minute)
+
+			err := rollbackKeyRotation()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("rollbackKeyRotation error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := keySlots(t, store); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("slots = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFallbackKeys(t *testing.T) {
+	tests := []struct {
+		name       string
+		slots      map[keySlot]string
+		rotatedAgo time.Duration
+		want       []slotKey
+	}{
+		{
+			name:       "pending before previous",
+			slots:      map[keySlot]string{slotActive: "a", slotPending: "p", slotPrevious: "o"},
+			rotatedAgo: time.Minute,
+			want:       []slotKey{{slotPending, "p"}, {slotPrevious, "o"}},
+		},
+		{
+			name:       "previous past the grace window",
+			slots:      map[keySlot]string{slotActive: "a", slotPending: "p", slotPrevious: "o"},
+			rotatedAgo: time.Hour,
+			want:       []slotKey{{slotPending, "p"}},
+		},
+		{
+			name:  "previous without a rotation time",
+			slots: map[keySlot]string{slotActive: "a", slotPrevious: "o"},
+		},
+		{
+			name:       "previous only",
+			slots:      map[keySlot]string{slotActive: "a", slotPrevious: "o"},
+			rotatedAgo: time.Minute,
+			want:       []slotKey{{slotPrevious, "o"}},
+		},
+		{
+			name:  "active only",
+			slots: map[keySlot]string{slotActive: "a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestKeyStore(t, tt.slots, tt.rotatedAgo)
+
+			if got := fallbackKeys(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fallbackKeys() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdoptKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		slots    map[keySlot]string
+		accepted slotKey
+		want     map[keySlot]string
+	}{
+		{
+			name:     "pending key commits the rotation",
+			slots:    map[keySlot]string{slotActive: "a", slotPending: "p"},
+			accepted: slotKey{slotPending, "p"},
+			want:     map[keySlot]string{slotActive: "p", slotPrevious: "a"},
+		},
+		{
+			name:     "previous key rolls the rotation back",
+			slots:    map[keySlot]string{slotActive: "a", slotPrevious: "o"},
+			accepted: slotKey{slotPrevious, "o"},
+			want:     map[keySlot]string{slotActive: "o"},
+		},
+		{
+			name:     "active key discards the pending key",
+			slots:    map[keySlot]string{slotActive: "a", slotPending: "p"},
+			accepted: slotKey{slotActive, "a"},
+			want:     map[keySlot]string{slotActive: "a"},
+		},
+		{
+			name:     "slot changed since the key was accepted",
+			slots:    map[keySlot]string{slotActive: "a", slotPending: "p2"},
+			accepted: slotKey{slotPending, "p"},
+			want:     map[keySlot]string{slotActive: "a", slotPending: "p2"},
+		},
+		{
+			name:     "slot emptied since the key was accepted",
+			slots:    map[keySlot]string{slotActive: "o"},
+			accepted: slotKey{slotPrevious, "o"},
+			want:     map[keySlot]string{slotActive: "o"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestKeyStore(t, tt.slots, time.Minute)
+
+			if err := adoptKey(tt.accepted); err != nil {
+				t.Fatalf("adoptKey: %v", err)
+			}
+			if got := keySlots(t, store); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("slots = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecoverKeyRotation(t *testing.T) {
+	tests := []struct {
+		name       string
+		slots      map[keySlot]string
+		rotatedAgo time.Duration
+		want       map[keySlot]string
+	}{
+		{
+			name:  "pending key without an active key",
+			slots: map[keySlot]string{slotPending: "p"},
+			want:  map[keySlot]string{slotActive: "p"},
+		},
+		{
+			name:       "pending key already activated",
+			slots:      map[keySlot]string{slotActive: "p", slotPending: "p", slotPrevious: "o"},
+			rotatedAgo: time.Minute,
+			want:       map[keySlot]string{slotActive: "p", slotPrevious: "o"},
+		},
+		{
+			name:       "unfinished rotation is left for the next request",
+			slots:      map[keySlot]string{slotActive: "a", slotPending: "p"},
+			rotatedAgo: time.Minute,
+			want:       map[keySlot]string{slotActive: "a", slotPending: "p"},
+		},
+		{
+			name:       "previous key past the grace window",
+			slots:      map[keySlot]string{slotActive: "a", slotPrevious: "o"},
+			rotatedAgo: time.Hour,
+			want:       map[keySlot]string{slotActive: "a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestKeyStore(t, tt.slots, tt.rotatedAgo)
+
+			recoverKeyRotation()
+			if got := keySlots(t, store); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("slots = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyFileMode is the only mode the key file may have
+const keyFileMode os.FileMode = 0600
+
+// Key file types reported by the tamper watcher
+const (
+	keyFileTypeRegular = "file"
+	keyFileTypeSymlink = "symlink"
+	keyFileTypeOther   = "other"
+)
+
+// keyFileState is the key file metadata the tamper watcher compares. The key
+// file itself is examined, never what a symlink in its place points to.
+type keyFileState struct {
+	Exists  bool      `json:"exists"`
+	Type    string    `json:"type,omitempty"`
+	Target  string    `json:"target,omitempty"`
+	Mode    string    `json:"mode,omitempty"`
+	UID     int       `json:"uid"`
+	GID     int       `json:"gid"`
+	Inode   uint64    `json:"inode,omitempty"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+
+	perm os.FileMode
+	hash [sha256.Size]byte
+}
+
+// keyWatch holds the key file state the beacon last saw or wrote itself,
+// and the key it held then. Changes the beacon makes are bracketed by
+// expectKeyFileChange so that only changes made by someone else are reported.
+var keyWatch struct {
+	mu       sync.Mutex
+	path     string
+	baseline keyFileState
+	key      string
+}
+
+// readKeyFileState reads the current metadata and contents of the key file.
+// A symlink or other non-regular file in its place is described but not
+// followed or read.
+func readKeyFileState(path string) (keyFileState, error) {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return keyFileState{}, nil
+	}
+	if err != nil {
+		return keyFileState{}, err
+	}
+
+	var content []byte
+	switch {
+	case info.Mode().IsRegular():
+		f, fi, err := openKeyFile(path)
+		if err != nil {
+			return keyFileState{}, err
+		}
+		content, err = io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return keyFileState{}, err
+		}
+		info = fi
+	case info.Mode()&os.ModeSymlink != 0:
+		target, _ := os.Readlink(path)
+		return describeKeyFile(info, keyFileTypeSymlink, target, nil), nil
+	default:
+		return describeKeyFile(info, keyFileTypeOther, "", nil), nil
+	}
+	return describeKeyFile(info, keyFileTypeRegular, "", content), nil
+}
+
+// describeKeyFile builds the state of an existing key file
+func describeKeyFile(info os.FileInfo, fileType, target string, content []byte) keyFileState {
+	state := keyFileState{
+		Exists:  true,
+		Type:    fileType,
+		Target:  target,
+		Mode:    info.Mode().Perm().String(),
+		Size:    info.Size(),
+		ModTime: info.ModTime().UTC(),
+		perm:    info.Mode().Perm(),
+		hash:    sha256.Sum256(content),
+	}
+	state.UID, state.GID, state.Inode = fileIdentity(info)
+	return state
+}
+
+// keyFileChanges lists what differs between two key file states
+func keyFileChanges(before, after keyFileState) []string {
+	switch {
+	case before.Exists && !after.Exists:
+		return []string{"deleted"}
+	case !before.Exists && after.Exists:
+		return []string{"created"}
+	case !before.Exists:
+		return nil
+	}
+
+	var changes []string
+	if before.Type != after.Type {
+		changes = append(changes, "type")
+	}
+	if before.hash != after.hash {
+		changes = append(changes, "content")
+	}
+	if before.Inode != after.Inode {
+		changes = append(changes, "inode")
+	}
+	if before.UID != after.UID {
+		changes = append(changes, "owner")
+	}
+	if before.GID != after.GID {
+		changes = append(changes, "group")
+	}
+	if before.perm != after.perm {
+		changes = append(changes, "mode")
+	}
+	return changes
+}
+
+// expectKeyFileChange marks the key file as being changed by the beacon
+// itself. Call the returned function once the change is complete:
+//
+//	defer expectKeyFileChange()()
+func expectKeyFileChange() func() {
+	keyWatch.mu.Lock()
+	return func() {
+		defer keyWatch.mu.Unlock()
+		if keyWatch.path == "" {
+			return
+		}
+		if state, err := readKeyFileState(keyWatch.path); err == nil {
+			keyWatch.baseline = state
+		}
+		keyWatch.key, _ = secretStore().Get(slotActive)
+	}
+}
+
+// startKeyWatcher records the key file's current state, enforces its
+// permissions and watches it for changes until ctx is cancelled. Only
+// secret stores that keep the key in a file can be watched.
+func startKeyWatcher(ctx context.Context) error {
+	fs, ok := secretStore().(fileBackedStore)
+	if !ok {
+		logger.Info("Key file tamper detection does not apply to this secret store", "store", secretStore().Name())
+		return nil
+	}
+	path := fs.path(slotActive)
+
+	var err error
+	keyWatch.mu.Lock()
+	keyWatch.path = path
+	keyWatch.baseline, err = readKeyFileState(path)
+	keyWatch.key, _ = secretStore().Get(slotActive)
+	keyWatch.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to read key file state: %v", err)
+	}
+
+	enforceKeyFilePermissions(ctx)
+
+	go watchKeyFile(ctx, path, func() { checkKeyFile(ctx) })
+	return nil
+}
+
+// enforceKeyFilePermissions repairs a key file that is readable or writable
+// by anyone but its owner when the watcher starts
+func enforceKeyFilePermissions(ctx context.Context) {
+	keyWatch.mu.Lock()
+	defer keyWatch.mu.Unlock()
+
+	before := keyWatch.baseline
+	if before.Exists && before.Type != keyFileTypeRegular {
+		logger.Error("Key file is not a regular file; it is not used or repaired", "path", keyWatch.path, "type", before.Type, "target", before.Target)
+		go reportEventWithKey(ctx, "key_file_tampered", keyTamperDetails(keyWatch.path, []string{"type"}, before, before, nil), keyWatch.key)
+		return
+	}
+	if !before.Exists || runtime.GOOS == "windows" || before.perm == keyFileMode {
+		return
+	}
+
+	repaired := repairKeyFile(keyWatch.path, before, before)
+	after, _ := readKeyFileState(keyWatch.path)
+	keyWatch.baseline = after
+
+	logger.Error("Key file had an insecure mode at startup", "path", keyWatch.path, "mode", before.Mode)
+	go reportEventWithKey(ctx, "key_file_tampered", keyTamperDetails(keyWatch.path, []string{"mode"}, before, after, repaired), keyWatch.key)
+}
+
+// checkKeyFile compares the key file with the expected state and reports
+// and repairs any change the beacon did not make
+func checkKeyFile(ctx context.Context) {
+	keyWatch.mu.Lock()
+	defer keyWatch.mu.Unlock()
+
+	observed, err := readKeyFileState(keyWatch.path)
+	if err != nil {
+		logger.Error("Failed to check key file", "path", keyWatch.path, "error", err)
+		return
+	}
+
+	before := keyWatch.baseline
+	changes := keyFileChanges(before, observed)
+	if len(changes) == 0 {
+		return
+	}
+
+	repaired := repairKeyFile(keyWatch.path, before, observed)
+	after := observed
+	if len(repaired) > 0 {
+		after, _ = readKeyFileState(keyWatch.path)
+	}
+	keyWatch.baseline = after
+
+	logger.Error("Key file was changed outside the beacon", "path", keyWatch.path, "changes", strings.Join(changes, ","))
+	if observed.Exists && observed.Type != keyFileTypeRegular {
+		logger.Error("Key file is no longer a regular file; it is not used or repaired until replaced by one", "path", keyWatch.path, "type", observed.Type, "target", observed.Target)
+	}
+
+	// A replaced key would not authenticate the report, so it is sent with
+	// the key the beacon last trusted
+	key := keyWatch.key
+	if key == "" {
+		key, _ = secretStore().Get(slotActive)
+		keyWatch.key = key
+	}
+	go reportEventWithKey(ctx, "key_file_tampered", keyTamperDetails(keyWatch.path, changes, before, observed, repaired), key)
+}
+
+// repairKeyFile restores the mode and ownership of the key file where it
+// can and returns what it repaired. The contents are left alone: they may
+// have been replaced on purpose, e.g. by re-enrolling. Only a regular file is
+// repaired, through a descriptor opened without following symlinks, so a
+// symlink swapped in cannot redirect the repair to another file.
+func repairKeyFile(path string, expected, observed keyFileState) []string {
+	if !observed.Exists || observed.Type != keyFileTypeRegular || runtime.GOOS == "windows" {
+		return nil
+	}
+
+	f, info, err := openKeyFile(path)
+	if err != nil {
+		logger.Error("Failed to open key file for repair", "path", path, "error", err)
+		return nil
+	}
+	defer f.Close()
+
+	var repaired []string
+	if info.Mode().Perm() != keyFileMode {
+		if err := f.Chmod(keyFileMode); err != nil {
+			logger.Error("Failed to repair key file mode", "path", path, "error", err)
+		} else {
+			repaired = append(repaired, "mode")
+		}
+	}
+
+	uid, gid := expected.UID, expected.GID
+	if !expected.Exists || expected.Type != keyFileTypeRegular {
+		uid, gid = os.Geteuid(), os.Getegid()
+	}
+	if fileUID, fileGID, _ := fileIdentity(info); fileUID != uid || fileGID != gid {
+		if err := f.Chown(uid, gid); err != nil {
+			logger.Error("Failed to repair key file ownership", "path", path, "error", err)
+		} else {
+			repaired = append(repaired, "owner")
+		}
+	}
+	return repaired
+}
+
+// keyTamperDetails builds the payload of a key_file_tampered event
+func keyTamperDetails(path string, changes []string, before, after keyFileState, repaired []string) map[string]interface{} {
+	if repaired == nil {
+		repaired = []string{}
+	}
+	return map[string]interface{}{
+		"path":     path,
+		"changes":  changes,
+		"before":   before,
+		"after":    after,
+		"repaired": repaired,
+	}
+}
@@ -0,0 +1,89 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchKeyFile calls check whenever inotify reports a change to the key
+// file. The directory is watched rather than the file, because replacing
+// the file (as atomic writes do) gives it a new inode. check also runs every
+// key_watch_interval in case events are missed.
+func watchKeyFile(ctx context.Context, path string, check func()) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		logger.Warn("inotify unavailable, polling the key file instead", "error", err)
+		pollKeyFile(ctx, check)
+		return
+	}
+	defer unix.Close(fd)
+
+	const mask = unix.IN_ATTRIB | unix.IN_MODIFY | unix.IN_CLOSE_WRITE | unix.IN_CREATE |
+		unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF
+	if _, err := unix.InotifyAddWatch(fd, filepath.Dir(path), mask); err != nil {
+		logger.Warn("Failed to watch the key directory, polling the key file instead", "path", filepath.Dir(path), "error", err)
+		pollKeyFile(ctx, check)
+		return
+	}
+
+	name := filepath.Base(path)
+	buf := make([]byte, 64*1024)
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	lastCheck := time.Now()
+
+	for ctx.Err() == nil {
+		if time.Since(lastCheck) >= cfg.KeyWatchInterval.Duration() {
+			check()
+			lastCheck = time.Now()
+		}
+
+		// Wake up regularly so that cancellation is noticed
+		n, err := unix.Poll(fds, 1000)
+		if err != nil && err != unix.EINTR {
+			logger.Warn("Key file watch failed, polling instead", "error", err)
+			pollKeyFile(ctx, check)
+			return
+		}
+		if n <= 0 {
+			continue
+		}
+
+		n, err = unix.Read(fd, buf)
+		if err != nil || n <= 0 {
+			continue
+		}
+		if keyFileEventSeen(buf[:n], name) {
+			check()
+			lastCheck = time.Now()
+		}
+	}
+}
+
+// keyFileEventSeen reports whether a batch of inotify events concerns the
+// named file or the watched directory itself
+func keyFileEventSeen(buf []byte, name string) bool {
+	for offset := 0; offset+unix.SizeofInotifyEvent <= len(buf); {
+		event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		nameStart := offset + unix.SizeofInotifyEvent
+		nameEnd := nameStart + int(event.Len)
+		if nameEnd > len(buf) {
+			break
+		}
+
+		eventName := string(buf[nameStart:nameEnd])
+		for len(eventName) > 0 && eventName[len(eventName)-1] == 0 {
+			eventName = eventName[:len(eventName)-1]
+		}
+		if eventName == name || event.Mask&(unix.IN_DELETE_SELF|unix.IN_MOVE_SELF) != 0 {
+			return true
+		}
+		offset = nameEnd
+	}
+	return false
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "context"
+
+// watchKeyFile polls the key file every key_watch_interval; only Linux has
+// change notifications wired up
+func watchKeyFile(ctx context.Context, path string, check func()) {
+	pollKeyFile(ctx, check)
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// pollKeyFile calls check every key_watch_interval until ctx is cancelled
+func pollKeyFile(ctx context.Context, check func()) {
+	ticker := time.NewTicker(cfg.KeyWatchInterval.Duration())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			check()
+		}
+	}
+}
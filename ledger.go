@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ledgerCompleted is the state of a task whose result the scorekeeper
+// acknowledged; such a task must never run again. Tasks that ran but are
+// not acknowledged yet are tracked by the outbox.
+const ledgerCompleted = "completed"
+
+// ledgerEntry records what the beacon has done for one task ID
+type ledgerEntry struct {
+	TaskID    string    `json:"task_id"`
+	TaskType  string    `json:"task_type"`
+	State     string    `json:"state"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// taskLedger is the on-disk record of completed task IDs. It keeps the
+// scorekeeper from getting a task run twice if it lists the task again.
+type taskLedger struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]*ledgerEntry
+}
+
+// Global task ledger instance
+var ledger *taskLedger
+
+// openLedger loads the ledger at path, dropping completed entries older
+// than the configured retention
+func openLedger(path string) (*taskLedger, error) {
+	l := &taskLedger{
+		path:    path,
+		entries: map[string]*ledgerEntry{},
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read task ledger: %v", err)
+	}
+	if err == nil {
+		var entries []*ledgerEntry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("failed to parse task ledger %s: %v", path, err)
+		}
+		for _, entry := range entries {
+			l.entries[entry.TaskID] = entry
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune()
+	return l, nil
+}
+
+// lookup returns the ledger entry for a task ID
+func (l *taskLedger) lookup(taskID string) (ledgerEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.entries[taskID]
+	if !ok {
+		return ledgerEntry{}, false
+	}
+	return *entry, true
+}
+
+// markCompleted records that the scorekeeper acknowledged a task's result
+func (l *taskLedger) markCompleted(task Task) error {
+	return l.update(&ledgerEntry{
+		TaskID:    task.ID,
+		TaskType:  task.TaskType,
+		State:     ledgerCompleted,
+		UpdatedAt: time.Now(),
+	})
+}
+
+// update stores an entry and persists the ledger
+func (l *taskLedger) update(entry *ledgerEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries[entry.TaskID] = entry
+	l.prune()
+	return l.save()
+}
+
+// prune drops completed entries older than the retention period, and
+// entries in any other state left by older versions; the caller must hold l.mu
+func (l *taskLedger) prune() {
+	cutoff := time.Now().Add(-cfg.LedgerRetention.Duration())
+	for id, entry := range l.entries {
+		if entry.State != ledgerCompleted || entry.UpdatedAt.Before(cutoff) {
+			delete(l.entries, id)
+		}
+	}
+}
+
+// save writes the ledger to disk; the caller must hold l.mu
+func (l *taskLedger) save() error {
+	entries := make([]*ledgerEntry, 0, len(l.entries))
+	for _, entry := range l.entries {
+		entries = append(entries, entry)
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(l.path, data, 0600)
+}
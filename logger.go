@@ -1,62 +1,47 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
 
 	"github.com/kardianos/service"
 )
 
-// Logger provides a unified logging interface for both console and service modes
-type Logger interface {
-	Info(format string, v ...interface{})
-	Error(format string, v ...interface{})
-}
-
-// ConsoleLogger logs to stdout/stderr (for interactive mode)
-type ConsoleLogger struct{}
-
-func (l *ConsoleLogger) Info(format string, v ...interface{}) {
-	fmt.Printf("[INFO] "+format+"\n", v...)
-}
-
-func (l *ConsoleLogger) Error(format string, v ...interface{}) {
-	fmt.Fprintf(os.Stderr, "[ERROR] "+format+"\n", v...)
-}
-
-// FileLogger logs to a file (for service mode)
-type FileLogger struct {
-	logger *log.Logger
-	file   *os.File
-}
-
-func (l *FileLogger) Info(format string, v ...interface{}) {
-	l.logger.Printf("[INFO] "+format, v...)
-}
-
-func (l *FileLogger) Error(format string, v ...interface{}) {
-	l.logger.Printf("[ERROR] "+format, v...)
-}
+// Log formats
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
 
-func (l *FileLogger) Close() error {
-	if l.file != nil {
-		return l.file.Close()
-	}
-	return nil
-}
+// Global logger instance. It discards everything until InitLogger runs, so
+// commands other than the daemon stay quiet.
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
 
-// Global logger instance
-var logger Logger
+// logLevel is the lowest level logged, set from log_level
+var logLevel = new(slog.LevelVar)
 
-// InitLogger initializes the appropriate logger based on execution mode
+// InitLogger initializes the logger based on execution mode: stdout and
+// stderr in console mode, the log file in service mode
 func InitLogger(svc service.Service) error {
+	logLevel.Set(cfg.logLevel)
+
 	// Check if running interactively (console) or as a service
 	if service.Interactive() {
-		// Console mode - log to stdout
-		logger = &ConsoleLogger{}
+		// Console mode - warnings and errors go to stderr
+		logger = slog.New(&logHandler{
+			out:    newLogFormatHandler(os.Stdout, false),
+			errOut: newLogFormatHandler(os.Stderr, false),
+		})
 		return nil
 	}
 
@@ -75,12 +60,26 @@ func InitLogger(svc service.Service) error {
 		return fmt.Errorf("failed to open log file: %v", err)
 	}
 
-	logger = &FileLogger{
-		logger: log.New(file, "", log.LstdFlags),
-		file:   file,
+	h := newLogFormatHandler(file, true)
+	logger = slog.New(&logHandler{out: h, errOut: h})
+	return nil
+}
+
+// newLogFormatHandler returns the handler for the configured log_format
+func newLogFormatHandler(w io.Writer, timestamps bool) slog.Handler {
+	if cfg.LogFormat == logFormatJSON {
+		return slog.NewJSONHandler(w, &slog.HandlerOptions{Level: logLevel, ReplaceAttr: formatLogDuration})
 	}
+	return &textHandler{w: w, mu: new(sync.Mutex), timestamps: timestamps}
+}
 
-	return nil
+// formatLogDuration writes durations as in the text format, e.g. "1.5s",
+// rather than as nanoseconds
+func formatLogDuration(groups []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindDuration {
+		a.Value = slog.StringValue(a.Value.Duration().String())
+	}
+	return a
 }
 
 // getLogFilePath returns the platform-specific log file path
@@ -97,16 +96,132 @@ func getLogFilePath() string {
 	}
 }
 
-// LogInfo logs an informational message
-func LogInfo(format string, v ...interface{}) {
-	if logger != nil {
-		logger.Info(format, v...)
+// taskLogger returns a logger that tags every message with the task
+func taskLogger(task Task) *slog.Logger {
+	return logger.With("task_id", task.ID, "task_type", task.TaskType)
+}
+
+// logHandler sends warnings and errors to errOut and everything else to
+// out, and keeps errors for the control socket status
+type logHandler struct {
+	out    slog.Handler
+	errOut slog.Handler
+	fields string
+}
+
+func (h *logHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= logLevel.Level()
+}
+
+func (h *logHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelError {
+		var b strings.Builder
+		b.WriteString(r.Message)
+		b.WriteString(h.fields)
+		r.Attrs(func(a slog.Attr) bool {
+			appendLogField(&b, "", a)
+			return true
+		})
+		recordRecentError(b.String())
+	}
+	if r.Level >= slog.LevelWarn {
+		return h.errOut.Handle(ctx, r)
+	}
+	return h.out.Handle(ctx, r)
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b strings.Builder
+	b.WriteString(h.fields)
+	for _, a := range attrs {
+		appendLogField(&b, "", a)
+	}
+	return &logHandler{out: h.out.WithAttrs(attrs), errOut: h.errOut.WithAttrs(attrs), fields: b.String()}
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	return &logHandler{out: h.out.WithGroup(name), errOut: h.errOut.WithGroup(name), fields: h.fields}
+}
+
+// textHandler writes "[LEVEL] message" lines as the beacon always has,
+// followed by the fields as key=value pairs. In the log file each line is
+// prefixed with the local time.
+type textHandler struct {
+	w          io.Writer
+	mu         *sync.Mutex
+	timestamps bool
+	fields     string // fields added by WithAttrs, already formatted
+	group      string // key prefix added by WithGroup
+}
+
+func (h *textHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= logLevel.Level()
+}
+
+func (h *textHandler) Handle(ctx context.Context, r slog.Record) error {
+	var b strings.Builder
+	if h.timestamps {
+		b.WriteString(r.Time.Format("2006/01/02 15:04:05 "))
+	}
+	b.WriteString("[" + r.Level.String() + "] " + r.Message)
+	b.WriteString(h.fields)
+	r.Attrs(func(a slog.Attr) bool {
+		appendLogField(&b, h.group, a)
+		return true
+	})
+	b.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	var b strings.Builder
+	b.WriteString(h.fields)
+	for _, a := range attrs {
+		appendLogField(&b, h.group, a)
 	}
+	h2.fields = b.String()
+	return &h2
 }
 
-// LogError logs an error message
-func LogError(format string, v ...interface{}) {
-	if logger != nil {
-		logger.Error(format, v...)
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.group = h.group + name + "."
+	return &h2
+}
+
+// appendLogField appends a field as " key=value", flattening groups into
+// dotted keys
+func appendLogField(b *strings.Builder, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			appendLogField(b, prefix, ga)
+		}
+		return
+	}
+
+	value := a.Value.String()
+	if a.Value.Kind() == slog.KindTime {
+		value = a.Value.Time().Format(time.RFC3339)
+	}
+	if value == "" || strings.IndexFunc(value, func(r rune) bool {
+		return r == ' ' || r == '=' || r == '"' || !unicode.IsPrint(r)
+	}) >= 0 {
+		value = strconv.Quote(value)
 	}
+	b.WriteString(" " + prefix + a.Key + "=" + value)
 }
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"runtime"
+	"strings"
 
 	"github.com/kardianos/service"
 )
@@ -13,12 +15,25 @@ const BuildDate = "2025-11-24"
 
 // Flow:
 // 1. Get tasks from ScoreKeeper or local file
-// 2. Pick top task, as they are ordered by priority (queue)
+// 2. Work through the queue in priority order, a few tasks at a time
 // 3. Execute task based on type
 // 4. Send the appropriate response back to ScoreKeeper
 // 5. Repeat every X seconds
 
 func main() {
+	// Split off the command and its arguments, if any; everything else is flags
+	cmd := ""
+	var cmdArgs []string
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd = args[0]
+		args = args[1:]
+	}
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmdArgs = append(cmdArgs, args[0])
+		args = args[1:]
+	}
+
 	// Service configuration
 	svcConfig := &service.Config{
 		Name:        "tally",
@@ -28,6 +43,44 @@ func main() {
 		Arguments: []string{},
 	}
 
+	// enroll takes its own flags besides the configuration flags
+	var enrollToken string
+	var enrollForce bool
+	if cmd == "enroll" {
+		var err error
+		enrollToken, enrollForce, args, err = parseEnrollArgs(append(cmdArgs, args...))
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Running the daemon, installing it or talking to the scorekeeper needs
+	// a valid configuration; flags given at install time are passed on to
+	// the installed service. Commands that only inspect or control the local
+	// beacon just need to find its state directory.
+	var loadConfig func([]string) (*Config, error)
+	switch cmd {
+	case "", "install", "enroll":
+		loadConfig = LoadConfig
+	case "outbox":
+		loadConfig = LoadLocalConfig
+		if len(cmdArgs) > 0 && cmdArgs[0] == "retry" {
+			loadConfig = LoadConfig
+		}
+	case "status", "trigger", "pause", "resume":
+		loadConfig = LoadLocalConfig
+	}
+	if loadConfig != nil {
+		c, err := loadConfig(args)
+		if err != nil {
+			fmt.Printf("Error loading configuration: %v\n", err)
+			os.Exit(1)
+		}
+		cfg = c
+		svcConfig.Arguments = args
+	}
+
 	// Create program instance
 	prg := &program{}
 
@@ -39,9 +92,7 @@ func main() {
 	}
 
 	// Handle service control commands (install, uninstall, start, stop)
-	if len(os.Args) > 1 {
-		cmd := os.Args[1]
-
+	if cmd != "" {
 		switch cmd {
 		case "status":
 			showStatus()
@@ -51,6 +102,27 @@ func main() {
 			showLogs()
 			return
 
+		case "enroll":
+			if err := enrollBeacon(context.Background(), enrollToken, enrollForce); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+
+		case "outbox":
+			if err := runOutboxCommand(cmdArgs); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+
+		case "trigger", "pause", "resume":
+			if err := runControlCommand(cmd); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+
 		case "version":
 			fmt.Printf("Tally Beacon Service v%s\n", Version)
 			fmt.Printf("Build: %s\n", BuildDate)
@@ -61,7 +133,7 @@ func main() {
 		default:
 			err = service.Control(s, cmd)
 			if err != nil {
-				fmt.Printf("Valid commands: install, uninstall, start, stop, restart, status, logs, version\n")
+				fmt.Printf("Valid commands: install, uninstall, start, stop, restart, status, logs, enroll, outbox, trigger, pause, resume, version\n")
 				fmt.Printf("Error: %v\n", err)
 				os.Exit(1)
 			}
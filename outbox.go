@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// outboxEntry is one task result waiting to be acknowledged by the scorekeeper
+type outboxEntry struct {
+	Seq       uint64          `json:"seq"`
+	Task      Task            `json:"task"`
+	Endpoint  string          `json:"endpoint"`
+	Envelope  json.RawMessage `json:"envelope"`
+	CreatedAt time.Time       `json:"created_at"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"last_error,omitempty"`
+
+	// Rejections counts the permanent rejections (4xx) of the entry; after
+	// maxOutboxRejections it is set aside as Rejected until `tally outbox retry`
+	Rejections int  `json:"rejections,omitempty"`
+	Rejected   bool `json:"rejected,omitempty"`
+
+	// Acked is set, together with the response, once the scorekeeper has
+	// accepted the result, so that a restart finishes the follow-up work
+	// instead of submitting it again
+	Acked    bool            `json:"acked,omitempty"`
+	Response json.RawMessage `json:"response,omitempty"`
+}
+
+// maxOutboxRejections is how often an entry may be rejected outright
+// before flush stops submitting it
+const maxOutboxRejections = 5
+
+// state describes the entry for `tally outbox list`
+func (e outboxEntry) state() string {
+	switch {
+	case e.Acked:
+		return "acked"
+	case e.Rejected:
+		return "rejected"
+	default:
+		return "queued"
+	}
+}
+
+// outbox is the disk-backed queue of task results. Every result is written
+// here (fsynced, one file per entry) before it is submitted, replayed in
+// order while the scorekeeper is reachable, and removed only once the
+// scorekeeper has acknowledged it with a 2xx response. The directory is
+// re-read on every operation so that `tally outbox` can manage it while the
+// daemon runs.
+type outbox struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// Global outbox instance
+var resultOutbox *outbox
+
+// openOutbox opens the outbox in dir, creating it if needed and removing
+// temporary files left by an interrupted write
+func openOutbox(dir string) (*outbox, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create outbox directory: %v", err)
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dir, ".*.tmp-*"))
+	for _, match := range matches {
+		os.Remove(match)
+	}
+	return &outbox{dir: dir}, nil
+}
+
+// entryPath returns the file holding the entry with the given sequence number
+func (o *outbox) entryPath(seq uint64) string {
+	return filepath.Join(o.dir, fmt.Sprintf("%020d.json", seq))
+}
+
+// entries returns every queued entry in submission order
+func (o *outbox) entries() ([]outboxEntry, error) {
+	files, err := os.ReadDir(o.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read outbox: %v", err)
+	}
+
+	var entries []outboxEntry
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(o.dir, name))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read outbox entry %s: %v", name, err)
+		}
+		var entry outboxEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			logger.Error("Skipping corrupt outbox entry", "entry", name, "error", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Seq < entries[j].Seq })
+	return entries, nil
+}
+
+// readEntry reads the entry with the given sequence number
+func (o *outbox) readEntry(seq uint64) (outboxEntry, error) {
+	var entry outboxEntry
+	data, err := os.ReadFile(o.entryPath(seq))
+	if err != nil {
+		return entry, err
+	}
+	err = json.Unmarshal(data, &entry)
+	return entry, err
+}
+
+// enqueue durably records a task result
+func (o *outbox) enqueue(task Task, env *resultEnvelope) (outboxEntry, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	raw, err := json.Marshal(env)
+	if err != nil {
+		return outboxEntry{}, err
+	}
+
+	entries, err := o.entries()
+	if err != nil {
+		return outboxEntry{}, err
+	}
+	var seq uint64 = 1
+	if len(entries) > 0 {
+		seq = entries[len(entries)-1].Seq + 1
+	}
+
+	entry := outboxEntry{
+		Seq:       seq,
+		Task:      task,
+		Endpoint:  env.endpoint(),
+		Envelope:  raw,
+		CreatedAt: time.Now().UTC(),
+	}
+	return entry, o.write(entry)
+}
+
+// write persists an entry
+func (o *outbox) write(entry outboxEntry) error {
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(o.entryPath(entry.Seq), data, 0600)
+}
+
+// update applies change to the entry as it is stored now and persists the
+// result. It reports false, without writing, if the entry has been removed,
+// e.g. by `tally outbox purge`.
+func (o *outbox) update(seq uint64, change func(*outboxEntry)) (bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	entry, err := o.readEntry(seq)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	change(&entry)
+	return true, o.write(entry)
+}
+
+// remove deletes an entry
+func (o *outbox) remove(seq uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := os.Remove(o.entryPath(seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return syncDir(o.dir)
+}
+
+// depth returns the number of queued entries
+func (o *outbox) depth() int {
+	entries, err := o.entries()
+	if err != nil {
+		return 0
+	}
+	return len(entries)
+}
+
+// pendingTaskIDs returns the IDs of tasks with a queued result
+func (o *outbox) pendingTaskIDs() map[string]bool {
+	ids := map[string]bool{}
+	entries, err := o.entries()
+	if err != nil {
+		return ids
+	}
+	for _, entry := range entries {
+		if entry.Task.ID != "" {
+			ids[entry.Task.ID] = true
+		}
+	}
+	return ids
+}
+
+// flush submits queued results in order. It stops at the first failure that
+// suggests the scorekeeper is unavailable; entries the scorekeeper rejects
+// outright are kept, with the error, for `tally outbox` and later retries,
+// and set aside after maxOutboxRejections. Submissions hold keyMu
+// exclusively because acknowledging a rotate_key result replaces the key
+// used by the entries after it.
+func (o *outbox) flush(ctx context.Context) error {
+	keyMu.Lock()
+	defer keyMu.Unlock()
+
+	entries, err := o.entries()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.Rejected {
+			continue
+		}
+
+		log := taskLogger(entry.Task).With("seq", entry.Seq)
+		env, ok := replayEnvelope(entry)
+		if !ok {
+			if entry.Acked {
+				log.Warn("Accepted result can no longer be followed up, recording it as completed")
+				o.complete(entry, log)
+				continue
+			}
+			log.Info("Recorded result is no longer valid, dropping it so the task runs again")
+			if err := o.remove(entry.Seq); err != nil {
+				log.Error("Failed to remove outbox entry", "error", err)
+			}
+			continue
+		}
+
+		if entry.Acked {
+			// Accepted before a restart; only the follow-up is left
+			if !taskCompleted(entry.Task) {
+				o.followUp(ctx, env, entry, log)
+			}
+			o.complete(entry, log)
+			continue
+		}
+
+		key, err := getKey()
+		if err != nil {
+			return fmt.Errorf("failed to get authentication key: %v", err)
+		}
+
+		response, err := submitResult(ctx, entry.Task, env, key)
+		if err != nil && ctx.Err() != nil {
+			// Interrupted, not failed: the entry is submitted again later
+			return ctx.Err()
+		}
+		if err != nil {
+			retryable := isRetryable(err) || errors.Is(err, errCircuitOpen)
+			_, werr := o.update(entry.Seq, func(e *outboxEntry) {
+				e.Attempts++
+				e.LastError = err.Error()
+				if retryable {
+					return
+				}
+				e.Rejections++
+				if e.Rejections >= maxOutboxRejections {
+					e.Rejected = true
+					log.Error("Scorekeeper keeps rejecting task result, setting it aside",
+						"rejections", e.Rejections, "error", err)
+				}
+			})
+			if werr != nil {
+				log.Error("Failed to update outbox entry", "error", werr)
+			}
+			if retryable {
+				return err
+			}
+			continue
+		}
+
+		// Journal the acknowledgement before acting on it, so that a crash
+		// during the follow-up neither loses it nor submits the result twice.
+		// An entry purged meanwhile has still been accepted, so its
+		// follow-up runs all the same.
+		entry.Acked = true
+		entry.Response = response
+		if _, err := o.update(entry.Seq, func(e *outboxEntry) {
+			e.Acked = true
+			e.Response = response
+			e.LastError = ""
+		}); err != nil {
+			log.Error("Failed to record acknowledgement in outbox entry", "error", err)
+		}
+		o.followUp(ctx, env, entry, log)
+		o.complete(entry, log)
+	}
+	return nil
+}
+
+// followUp runs the follow-up work of an acknowledged entry
+func (o *outbox) followUp(ctx context.Context, env *resultEnvelope, entry outboxEntry, log *slog.Logger) {
+	if err := env.acknowledged(ctx, entry.Response); err != nil {
+		log.Error("Submitted task result but its follow-up failed", "error", err)
+	}
+}
+
+// complete records an acknowledged entry in the ledger and removes it. The
+// ledger is written first: an entry left behind by a crash in between is
+// then only removed on replay.
+func (o *outbox) complete(entry outboxEntry, log *slog.Logger) {
+	markTaskCompleted(entry.Task)
+	if err := o.remove(entry.Seq); err != nil {
+		log.Error("Failed to remove acknowledged outbox entry", "error", err)
+	}
+}
+
+// requeueRejected makes entries set aside after repeated rejections eligible
+// for submission again
+func (o *outbox) requeueRejected() error {
+	entries, err := o.entries()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Rejected {
+			continue
+		}
+		if _, err := o.update(entry.Seq, func(e *outboxEntry) {
+			e.Rejected = false
+			e.Rejections = 0
+		}); err != nil {
+			return fmt.Errorf("failed to requeue outbox entry %d: %v", entry.Seq, err)
+		}
+	}
+	return nil
+}
+
+// replayEnvelope rebuilds the envelope of an outbox entry. Successful
+// results of resumable handlers are rebuilt through the handler so that
+// their follow-up work still runs; everything else is resubmitted as
+// recorded. It reports false if the task has to run again.
+func replayEnvelope(entry outboxEntry) (*resultEnvelope, bool) {
+	var stored struct {
+		resultEnvelope
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(entry.Envelope, &stored); err != nil {
+		return nil, false
+	}
+
+	if stored.Status == taskStatusSucceeded {
+		if h, ok := lookupTaskHandler(entry.Task.TaskType); ok {
+			if _, ok := h.(resumableHandler); ok {
+				return resumeEnvelope(entry.Task, entry.Envelope)
+			}
+		}
+	}
+
+	env := stored.resultEnvelope
+	if len(stored.Payload) > 0 {
+		env.setResult(recordedResult{endpoint: entry.Endpoint, payload: stored.Payload})
+	}
+	return &env, true
+}
+
+// recordedResult is a payload replayed verbatim from the outbox
+type recordedResult struct {
+	endpoint string
+	payload  json.RawMessage
+}
+
+// Endpoint implements TaskResult
+func (r recordedResult) Endpoint() string {
+	return r.endpoint
+}
+
+// Acknowledged implements TaskResult; only resumable handlers have follow-up work
+func (r recordedResult) Acknowledged(ctx context.Context) error {
+	return nil
+}
+
+// MarshalJSON submits the payload exactly as it was recorded
+func (r recordedResult) MarshalJSON() ([]byte, error) {
+	return r.payload, nil
+}
+
+// parseOutboxSeq parses a sequence number given on the command line
+func parseOutboxSeq(s string) (uint64, error) {
+	seq, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid outbox entry %q", s)
+	}
+	return seq, nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func init() {
+	registerTaskHandler(outboxTestHandler{})
+}
+
+// outboxTestHandler is a resumable task type whose follow-up work calls
+// outboxTestFollowUp, so that tests can observe when it runs
+type outboxTestHandler struct{}
+
+func (outboxTestHandler) Type() string {
+	return "outbox_test"
+}
+
+func (outboxTestHandler) Validate(task Task) error {
+	return nil
+}
+
+func (outboxTestHandler) Run(ctx context.Context, task Task) (TaskResult, error) {
+	return outboxTestResult{Value: task.ID}, nil
+}
+
+// Resume rebuilds the result unless it was recorded as "expired"
+func (outboxTestHandler) Resume(task Task, recorded json.RawMessage) (TaskResult, bool) {
+	var r outboxTestResult
+	if err := json.Unmarshal(recorded, &r); err != nil || r.Value == "expired" {
+		return nil, false
+	}
+	return r, true
+}
+
+// outboxTestResult is the result of an outbox_test task
+type outboxTestResult struct {
+	Value string `json:"value"`
+}
+
+func (r outboxTestResult) Endpoint() string {
+	return "outbox_test"
+}
+
+func (r outboxTestResult) Acknowledged(ctx context.Context) error {
+	if outboxTestFollowUp != nil {
+		outboxTestFollowUp(r)
+	}
+	return nil
+}
+
+// outboxTestFollowUp is called by the follow-up work of outbox_test results
+var outboxTestFollowUp func(outboxTestResult)
+
+// outboxTestServer counts the results submitted to it
+type outboxTestServer struct {
+	submissions atomic.Int32
+}
+
+// newTestOutbox returns an empty outbox submitting to a scorekeeper that
+// answers every submission with respond, and a fresh ledger
+func newTestOutbox(t *testing.T, respond func(w http.ResponseWriter, body string)) (*outbox, *outboxTestServer) {
+	t.Helper()
+
+	server := &outboxTestServer{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		server.submissions.Add(1)
+		respond(w, string(body))
+	}))
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	c := defaultConfig()
+	c.Endpoint = srv.URL
+	c.AllowInsecureHTTP = true
+	c.AuthMode = authModeBearer
+	c.RetryAttempts = 1
+	c.BeaconID = "beacon-1"
+	c.StateDir = dir
+	c.secretStore = envStore{name: "TALLY_TEST_BEACON_KEY"}
+	withConfig(t, c)
+	t.Setenv("TALLY_TEST_BEACON_KEY", "k1")
+
+	oldBreaker, oldLedger := breaker, ledger
+	breaker = &circuitBreaker{state: breakerClosed}
+	l, err := openLedger(filepath.Join(dir, "ledger.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ledger = l
+	t.Cleanup(func() {
+		breaker, ledger = oldBreaker, oldLedger
+		outboxTestFollowUp = nil
+	})
+
+	o, err := openOutbox(filepath.Join(dir, "outbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o, server
+}
+
+// enqueueTestResult queues a successful outbox_test result for task id
+func enqueueTestResult(t *testing.T, o *outbox, id, value string) outboxEntry {
+	t.Helper()
+	task := Task{ID: id, TaskType: "outbox_test"}
+	env := &resultEnvelope{TaskID: id, TaskType: task.TaskType, BeaconID: cfg.BeaconID, Status: taskStatusSucceeded}
+	env.setResult(outboxTestResult{Value: value})
+	entry, err := o.enqueue(task, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entry
+}
+
+// accept answers a submission with 200 and a fixed response
+func accept(w http.ResponseWriter, body string) {
+	w.Write([]byte(`{"accepted":true}`))
+}
+
+func TestOutboxFlushJournalsBeforeFollowUp(t *testing.T) {
+	o, server := newTestOutbox(t, accept)
+	entry := enqueueTestResult(t, o, "t1", "v1")
+
+	followUps := 0
+	outboxTestFollowUp = func(r outboxTestResult) {
+		followUps++
+		stored, err := o.readEntry(entry.Seq)
+		if err != nil {
+			t.Fatalf("outbox entry gone before its follow-up: %v", err)
+		}
+		var response bytes.Buffer
+		json.Compact(&response, stored.Response)
+		if !stored.Acked || response.String() != `{"accepted":true}` {
+			t.Errorf("entry before follow-up: acked=%v response=%s, want the acknowledgement recorded", stored.Acked, stored.Response)
+		}
+		if taskCompleted(entry.Task) {
+			t.Error("task recorded as completed before its follow-up")
+		}
+	}
+
+	if err := o.flush(context.Background()); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if followUps != 1 || server.submissions.Load() != 1 {
+		t.Fatalf("follow-ups = %d, submissions = %d, want 1 and 1", followUps, server.submissions.Load())
+	}
+	if !taskCompleted(entry.Task) {
+		t.Error("task not recorded as completed")
+	}
+	if n := o.depth(); n != 0 {
+		t.Errorf("outbox depth = %d, want 0", n)
+	}
+}
+
+func TestOutboxFlushFinishesAckedEntry(t *testing.T) {
+	tests := []struct {
+		name          string
+		completed     bool // the crash came after the ledger was written
+		wantFollowUps int
+	}{
+		{name: "crash before follow-up", wantFollowUps: 1},
+		{name: "crash after ledger", completed: true, wantFollowUps: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, server := newTestOutbox(t, accept)
+			entry := enqueueTestResult(t, o, "t1", "v1")
+			if _, err := o.update(entry.Seq, func(e *outboxEntry) {
+				e.Acked = true
+				e.Response = json.RawMessage(`{"accepted":true}`)
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if tt.completed {
+				markTaskCompleted(entry.Task)
+			}
+
+			followUps := 0
+			outboxTestFollowUp = func(outboxTestResult) { followUps++ }
+
+			if err := o.flush(context.Background()); err != nil {
+				t.Fatalf("flush: %v", err)
+			}
+			if n := server.submissions.Load(); n != 0 {
+				t.Errorf("acked entry submitted %d times, want 0", n)
+			}
+			if followUps != tt.wantFollowUps {
+				t.Errorf("follow-ups = %d, want %d", followUps, tt.wantFollowUps)
+			}
+			if !taskCompleted(entry.Task) {
+				t.Error("task not recorded as completed")
+			}
+			if n := o.depth(); n != 0 {
+				t.Errorf("outbox depth = %d, want 0", n)
+			}
+		})
+	}
+}
+
+func TestOutboxFlushSetsAsideRejectedEntry(t *testing.T) {
+	o, server := newTestOutbox(t, func(w http.ResponseWriter, body string) {
+		if strings.Contains(body, `"bad"`) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		accept(w, body)
+	})
+	bad := enqueueTestResult(t, o, "bad", "v1")
+
+	for i := 1; i <= maxOutboxRejections; i++ {
+		good := enqueueTestResult(t, o, "good", "v1")
+		if err := o.flush(context.Background()); err != nil {
+			t.Fatalf("flush %d: %v", i, err)
+		}
+		if _, err := o.readEntry(good.Seq); !os.IsNotExist(err) {
+			t.Fatalf("flush %d: entry after a rejected one was not submitted", i)
+		}
+
+		stored, err := o.readEntry(bad.Seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Rejections != i || stored.Attempts != i {
+			t.Errorf("flush %d: rejections = %d, attempts = %d", i, stored.Rejections, stored.Attempts)
+		}
+		if want := i == maxOutboxRejections; stored.Rejected != want {
+			t.Errorf("flush %d: rejected = %v, want %v", i, stored.Rejected, want)
+		}
+	}
+
+	before := server.submissions.Load()
+	if err := o.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.submissions.Load() - before; n != 0 {
+		t.Errorf("set-aside entry submitted %d more times", n)
+	}
+	if stored, _ := o.readEntry(bad.Seq); stored.state() != "rejected" {
+		t.Errorf("state = %q, want rejected", stored.state())
+	}
+
+	if err := o.requeueRejected(); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := o.readEntry(bad.Seq)
+	if stored.Rejected || stored.Rejections != 0 {
+		t.Errorf("after requeue: rejected = %v, rejections = %d", stored.Rejected, stored.Rejections)
+	}
+}
+
+func TestOutboxFlushDropsInvalidEntry(t *testing.T) {
+	tests := []struct {
+		name     string
+		envelope string
+	}{
+		{name: "handler cannot resume", envelope: `{"task_type":"outbox_test","status":"succeeded","payload":{"value":"expired"}}`},
+		{name: "corrupt envelope", envelope: `"not an envelope"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, server := newTestOutbox(t, accept)
+			entry := enqueueTestResult(t, o, "t1", "v1")
+			if _, err := o.update(entry.Seq, func(e *outboxEntry) {
+				e.Envelope = json.RawMessage(tt.envelope)
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := o.flush(context.Background()); err != nil {
+				t.Fatalf("flush: %v", err)
+			}
+			if n := server.submissions.Load(); n != 0 {
+				t.Errorf("invalid entry submitted %d times", n)
+			}
+			if n := o.depth(); n != 0 {
+				t.Errorf("outbox depth = %d, want 0", n)
+			}
+			if taskCompleted(entry.Task) {
+				t.Error("dropped task recorded as completed, it would not run again")
+			}
+		})
+	}
+}
+
+func TestOutboxUpdateSkipsRemovedEntry(t *testing.T) {
+	o, _ := newTestOutbox(t, accept)
+	entry := enqueueTestResult(t, o, "t1", "v1")
+	if err := o.remove(entry.Seq); err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := o.update(entry.Seq, func(e *outboxEntry) { e.Attempts++ })
+	if ok || err != nil {
+		t.Fatalf("update of a removed entry = %v, %v; want false, nil", ok, err)
+	}
+	if _, err := os.Stat(o.entryPath(entry.Seq)); !os.IsNotExist(err) {
+		t.Error("update brought back a removed entry")
+	}
+}
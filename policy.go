@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// pathPolicy is the local allowlist of file paths the scorekeeper may name
+// in tasks, keyed by task type. It is maintained by the blue team on the
+// host, so a compromised or spoofed scorekeeper cannot point the beacon at
+// arbitrary files. Patterns use filepath.Match syntax; a pattern ending in
+// "/**" matches everything below that directory.
+//
+//	allow:
+//	  check_control:
+//	    - /home/*/ctrl.txt
+//	  process_file:
+//	    - /var/www/**
+type pathPolicy struct {
+	Allow map[string][]string `yaml:"allow"`
+}
+
+// policyState tracks the loaded policy and the file it came from
+var policyState struct {
+	mu      sync.RWMutex
+	policy  *pathPolicy
+	modTime time.Time
+	err     error
+}
+
+// defaultPolicyFilePath returns the platform-specific policy file path
+func defaultPolicyFilePath() string {
+	switch runtime.GOOS {
+	case "windows":
+		return "C:\\Tally\\policy.yaml"
+	default:
+		return "/etc/tally/policy.yaml"
+	}
+}
+
+// loadPathPolicy reads and checks the policy file. It returns nil without
+// an error if there is no policy file, in which case every path is allowed.
+func loadPathPolicy(path string) (*pathPolicy, time.Time, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to stat policy file: %v", err)
+	}
+
+	// The policy guards root-level file access, so only root may change it
+	if runtime.GOOS != "windows" {
+		if uid, ok := fileOwnerUID(info); !ok || uid != 0 {
+			return nil, time.Time{}, fmt.Errorf("policy file %s must be owned by root", path)
+		}
+		if info.Mode().Perm()&0022 != 0 {
+			return nil, time.Time{}, fmt.Errorf("policy file %s must not be writable by group or others (mode %s)", path, info.Mode().Perm())
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to read policy file: %v", err)
+	}
+
+	var p pathPolicy
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&p); err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to parse policy file %s: %v", path, err)
+	}
+	for taskType, patterns := range p.Allow {
+		for _, pattern := range patterns {
+			if _, err := filepath.Match(strings.TrimSuffix(pattern, "/**"), ""); err != nil {
+				return nil, time.Time{}, fmt.Errorf("invalid pattern %q for %s in policy file: %v", pattern, taskType, err)
+			}
+		}
+	}
+
+	return &p, info.ModTime(), nil
+}
+
+// initPathPolicy loads the policy at daemon startup
+func initPathPolicy() error {
+	p, modTime, err := loadPathPolicy(cfg.PolicyFile)
+	if err != nil {
+		return err
+	}
+
+	policyState.mu.Lock()
+	policyState.policy, policyState.modTime, policyState.err = p, modTime, nil
+	policyState.mu.Unlock()
+
+	if p == nil {
+		logger.Info("No path policy, task file paths are not restricted", "path", cfg.PolicyFile)
+	} else {
+		logger.Info("Loaded path policy", "path", cfg.PolicyFile)
+	}
+	return nil
+}
+
+// refreshPathPolicy reloads the policy if the file changed since it was
+// loaded. If the new policy is invalid, every path is denied until fixed.
+func refreshPathPolicy() {
+	var modTime time.Time
+	if info, err := os.Stat(cfg.PolicyFile); err == nil {
+		modTime = info.ModTime()
+	}
+
+	policyState.mu.RLock()
+	unchanged := modTime.Equal(policyState.modTime) && policyState.err == nil
+	policyState.mu.RUnlock()
+	if unchanged {
+		return
+	}
+
+	p, modTime, err := loadPathPolicy(cfg.PolicyFile)
+
+	policyState.mu.Lock()
+	policyState.policy, policyState.modTime, policyState.err = p, modTime, err
+	policyState.mu.Unlock()
+
+	switch {
+	case err != nil:
+		logger.Error("Path policy is invalid, denying all task file paths", "path", cfg.PolicyFile, "error", err)
+	case p == nil:
+		logger.Info("Path policy removed, task file paths are not restricted")
+	default:
+		logger.Info("Reloaded path policy", "path", cfg.PolicyFile)
+	}
+}
+
+// checkPathPolicy returns a taskError if the local policy does not allow
+// the task's file path
+func checkPathPolicy(task Task) error {
+	if task.FilePath == "" {
+		return nil
+	}
+
+	policyState.mu.RLock()
+	p, policyErr := policyState.policy, policyState.err
+	policyState.mu.RUnlock()
+
+	if policyErr != nil {
+		return newTaskError(ErrCodePolicyDenied, "denied by local policy: policy file is invalid")
+	}
+	if p == nil {
+		return nil
+	}
+
+	if !filepath.IsAbs(task.FilePath) || filepath.Clean(task.FilePath) != task.FilePath {
+		return newTaskError(ErrCodePolicyDenied, "denied by local policy: path must be absolute and clean")
+	}
+
+	for _, pattern := range p.Allow[task.TaskType] {
+		if matchPolicyPattern(pattern, task.FilePath) {
+			return nil
+		}
+	}
+	return newTaskError(ErrCodePolicyDenied, "denied by local policy: %s not allowed for %s", task.FilePath, task.TaskType)
+}
+
+// matchPolicyPattern matches a path against one policy pattern
+func matchPolicyPattern(pattern, path string) bool {
+	if dir, ok := strings.CutSuffix(pattern, "/**"); ok {
+		for p := filepath.Dir(path); ; p = filepath.Dir(p) {
+			if matched, _ := filepath.Match(dir, p); matched {
+				return true
+			}
+			if p == filepath.Dir(p) {
+				return false
+			}
+		}
+	}
+
+	matched, _ := filepath.Match(pattern, path)
+	return matched
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestMatchPolicyPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"/home/blue/ctrl.txt", "/home/blue/ctrl.txt", true},
+		{"/home/blue/ctrl.txt", "/home/red/ctrl.txt", false},
+		{"/home/*/ctrl.txt", "/home/blue/ctrl.txt", true},
+		{"/home/*/ctrl.txt", "/home/blue/sub/ctrl.txt", false},
+		{"/home/*/ctrl.txt", "/home/ctrl.txt", false},
+		{"/var/log/*.log", "/var/log/auth.log", true},
+		{"/var/log/*.log", "/var/log/auth.log.1", false},
+		{"/var/www/**", "/var/www/index.html", true},
+		{"/var/www/**", "/var/www/a/b/c.php", true},
+		{"/var/www/**", "/var/www", false},
+		{"/var/www/**", "/var/wwwroot/index.html", false},
+		{"/var/www/**", "/var/index.html", false},
+		{"/srv/*/data/**", "/srv/app/data/x/y", true},
+		{"/srv/*/data/**", "/srv/app/other/x", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchPolicyPattern(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("matchPolicyPattern(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
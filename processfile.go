@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Limits on what a process_file task may ask for and send back
+const (
+	maxFileOperations = 32
+	maxRegexMatches   = 100
+	maxExtractLength  = 4096
+	maxReportSize     = 1024 * 1024
+)
+
+func init() {
+	registerTaskHandler(processFileHandler{})
+}
+
+// processFileHandler analyses a file with the operations listed in the task:
+//
+//	sha256         hex SHA-256 of the file
+//	line_count     number of lines
+//	regex_match    whether any line matches pattern, and how many do
+//	regex_extract  matches of pattern (or its first capture group)
+//	field          value at field in a json, yaml or csv document; the path
+//	               is dot-separated, e.g. "users.0.name", and for csv is
+//	               "<row>.<column>" with the column given by header or index
+//
+// Extracted values are cut at maxExtractLength, without splitting a UTF-8
+// character, and flagged as truncated; a field holding a list or map that is
+// too long is reported as its truncated JSON text. Once the report reaches
+// maxReportSize, the remaining operations report an error instead of a value
+// and the report is flagged as truncated.
+type processFileHandler struct{}
+
+func (processFileHandler) Type() string {
+	return "process_file"
+}
+
+func (processFileHandler) Validate(task Task) error {
+	if task.FilePath == "" {
+		return fmt.Errorf("file_path is required")
+	}
+	if len(task.Operations) == 0 {
+		return fmt.Errorf("at least one operation is required")
+	}
+	if len(task.Operations) > maxFileOperations {
+		return fmt.Errorf("too many operations (%d, max %d)", len(task.Operations), maxFileOperations)
+	}
+
+	for i, op := range task.Operations {
+		switch op.Op {
+		case "sha256", "line_count":
+		case "regex_match", "regex_extract":
+			if op.Pattern == "" {
+				return fmt.Errorf("operation %d (%s): pattern is required", i, op.Op)
+			}
+			if _, err := regexp.Compile(op.Pattern); err != nil {
+				return fmt.Errorf("operation %d (%s): invalid pattern: %v", i, op.Op, err)
+			}
+		case "field":
+			if op.Field == "" {
+				return fmt.Errorf("operation %d (field): field is required", i)
+			}
+			switch op.Format {
+			case "json", "yaml", "csv":
+			default:
+				return fmt.Errorf("operation %d (field): format must be json, yaml or csv, got %q", i, op.Format)
+			}
+		default:
+			return fmt.Errorf("operation %d: unknown operation %q", i, op.Op)
+		}
+	}
+	return nil
+}
+
+func (processFileHandler) Run(ctx context.Context, task Task) (TaskResult, error) {
+	resp := processFileResponse{FilePath: task.FilePath}
+
+	content, err := readTaskFile(ctx, task.FilePath, false)
+	if err != nil {
+		return resp, err
+	}
+	resp.Size = len(content)
+
+	size := 0
+	for _, op := range task.Operations {
+		if err := ctx.Err(); err != nil {
+			return resp, err
+		}
+
+		result := operationResult{Op: op.Op, Field: op.Field}
+		value, err := runFileOperation(op, content)
+		switch {
+		case err != nil:
+			result.Error = err.Error()
+		case op.Op == "field":
+			result.Value, result.Truncated = capFieldValue(value)
+		default:
+			result.Value = value
+		}
+
+		encoded, err := json.Marshal(result)
+		if err != nil {
+			result.Value = nil
+			result.Error = fmt.Sprintf("value cannot be reported: %v", err)
+		} else if size+len(encoded) > maxReportSize {
+			result.Value = nil
+			result.Error = fmt.Sprintf("report size limit of %d bytes reached", maxReportSize)
+			resp.Truncated = true
+		} else {
+			size += len(encoded)
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	return resp, nil
+}
+
+// processFileResponse contains the report of a process_file task
+type processFileResponse struct {
+	FilePath string            `json:"file_path"`
+	Size     int               `json:"size"`
+	Results  []operationResult `json:"results,omitempty"`
+
+	// Truncated is set when operations were left out to stay within maxReportSize
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// operationResult is the outcome of one file operation, in task order
+type operationResult struct {
+	Op    string      `json:"op"`
+	Field string      `json:"field,omitempty"`
+	Value interface{} `json:"value"`
+	Error string      `json:"error,omitempty"`
+
+	// Truncated is set when a field value was cut at maxExtractLength, and
+	// stays set if the value is then left out to stay within maxReportSize
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// Endpoint implements TaskResult
+func (r processFileResponse) Endpoint() string {
+	return "process_file"
+}
+
+// Acknowledged implements TaskResult; analysis leaves nothing to clean up
+func (r processFileResponse) Acknowledged(ctx context.Context) error {
+	return nil
+}
+
+// regexMatchResult is the value reported by regex_match
+type regexMatchResult struct {
+	Matched       bool `json:"matched"`
+	MatchingLines int  `json:"matching_lines"`
+}
+
+// regexExtractResult is the value reported by regex_extract
+type regexExtractResult struct {
+	Matches   []string `json:"matches"`
+	Truncated bool     `json:"truncated,omitempty"`
+}
+
+// runFileOperation applies one operation to the file contents
+func runFileOperation(op fileOperation, content []byte) (interface{}, error) {
+	switch op.Op {
+	case "sha256":
+		sum := sha256.Sum256(content)
+		return hex.EncodeToString(sum[:]), nil
+
+	case "line_count":
+		return countLines(content), nil
+
+	case "regex_match":
+		re := regexp.MustCompile(op.Pattern)
+		var result regexMatchResult
+		for _, line := range strings.Split(string(content), "\n") {
+			if re.MatchString(line) {
+				result.MatchingLines++
+			}
+		}
+		result.Matched = result.MatchingLines > 0
+		return result, nil
+
+	case "regex_extract":
+		re := regexp.MustCompile(op.Pattern)
+		result := regexExtractResult{Matches: []string{}}
+		for _, match := range re.FindAllStringSubmatch(string(content), maxRegexMatches+1) {
+			if len(result.Matches) == maxRegexMatches {
+				result.Truncated = true
+				break
+			}
+			value := match[0]
+			if len(match) > 1 {
+				value = match[1]
+			}
+			if len(value) > maxExtractLength {
+				value = truncateUTF8(value, maxExtractLength)
+				result.Truncated = true
+			}
+			result.Matches = append(result.Matches, value)
+		}
+		return result, nil
+
+	case "field":
+		return lookupField(op.Format, op.Field, content)
+	}
+
+	return nil, fmt.Errorf("unknown operation %q", op.Op)
+}
+
+// capFieldValue cuts a field value at maxExtractLength. Lists and maps are
+// measured as JSON and, when too long, replaced by their truncated JSON text.
+func capFieldValue(value interface{}) (interface{}, bool) {
+	if s, ok := value.(string); ok {
+		if len(s) > maxExtractLength {
+			return truncateUTF8(s, maxExtractLength), true
+		}
+		return s, false
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil || len(encoded) <= maxExtractLength {
+		return value, false
+	}
+	return truncateUTF8(string(encoded), maxExtractLength), true
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a UTF-8 sequence
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for i := n; i >= 0 && i > n-utf8.UTFMax; i-- {
+		if utf8.RuneStart(s[i]) {
+			return s[:i]
+		}
+	}
+	return s[:n]
+}
+
+// countLines counts lines the way wc -l would, plus a final unterminated line
+func countLines(content []byte) int {
+	lines := bytes.Count(content, []byte("\n"))
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		lines++
+	}
+	return lines
+}
+
+// lookupField returns the value at a dot-separated path in a structured document
+func lookupField(format, field string, content []byte) (interface{}, error) {
+	path := strings.Split(field, ".")
+
+	switch format {
+	case "json":
+		var doc interface{}
+		if err := json.Unmarshal(content, &doc); err != nil {
+			return nil, fmt.Errorf("invalid json: %v", err)
+		}
+		return walkPath(doc, path)
+
+	case "yaml":
+		var doc interface{}
+		if err := yaml.Unmarshal(content, &doc); err != nil {
+			return nil, fmt.Errorf("invalid yaml: %v", err)
+		}
+		return walkPath(doc, path)
+
+	case "csv":
+		return lookupCSVField(content, path)
+	}
+
+	return nil, fmt.Errorf("unsupported format %q", format)
+}
+
+// walkPath follows path through nested maps and lists
+func walkPath(doc interface{}, path []string) (interface{}, error) {
+	current := doc
+	for i, segment := range path {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[segment]
+			if !ok {
+				return nil, fmt.Errorf("field %q not found", strings.Join(path[:i+1], "."))
+			}
+			current = value
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, fmt.Errorf("index %q out of range at %q", segment, strings.Join(path[:i], "."))
+			}
+			current = node[index]
+		default:
+			return nil, fmt.Errorf("field %q not found", strings.Join(path[:i+1], "."))
+		}
+	}
+	return current, nil
+}
+
+// lookupCSVField returns the cell at "<row>.<column>", where row counts data
+// rows after the header and column is a header name or index
+func lookupCSVField(content []byte, path []string) (interface{}, error) {
+	if len(path) != 2 {
+		return nil, fmt.Errorf("csv field must be <row>.<column>")
+	}
+
+	records, err := csv.NewReader(bytes.NewReader(content)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid csv: %v", err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("csv has no header row")
+	}
+	header, rows := records[0], records[1:]
+
+	row, err := strconv.Atoi(path[0])
+	if err != nil || row < 0 || row >= len(rows) {
+		return nil, fmt.Errorf("row %q out of range (%d rows)", path[0], len(rows))
+	}
+
+	column := -1
+	for i, name := range header {
+		if name == path[1] {
+			column = i
+			break
+		}
+	}
+	if column < 0 {
+		if column, err = strconv.Atoi(path[1]); err != nil {
+			return nil, fmt.Errorf("column %q not found", path[1])
+		}
+	}
+	if column < 0 || column >= len(rows[row]) {
+		return nil, fmt.Errorf("column %q out of range", path[1])
+	}
+	return rows[row][column], nil
+}
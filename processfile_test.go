@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateUTF8(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		n    int
+		want string
+	}{
+		{name: "short enough", s: "abc", n: 3, want: "abc"},
+		{name: "ascii", s: "abcdef", n: 3, want: "abc"},
+		{name: "at a boundary", s: "ab€cd", n: 5, want: "ab€"},
+		{name: "inside a 2-byte character", s: "aé", n: 2, want: "a"},
+		{name: "inside a 3-byte character", s: "ab€", n: 4, want: "ab"},
+		{name: "inside a 4-byte character", s: "a😀b", n: 4, want: "a"},
+		{name: "first character too long", s: "😀", n: 2, want: ""},
+		{name: "invalid bytes", s: "\xff\xff\xff\xff\xff\xff", n: 4, want: "\xff\xff\xff\xff"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := truncateUTF8(tt.s, tt.n); got != tt.want {
+				t.Errorf("truncateUTF8(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractedValuesKeepUTF8(t *testing.T) {
+	long := strings.Repeat("€", maxExtractLength)
+
+	tests := []struct {
+		name  string
+		value interface{}
+	}{
+		{name: "string", value: long},
+		{name: "list", value: []interface{}{"a", long}},
+	}
+	for _, tt := range tests {
+		t.Run("field "+tt.name, func(t *testing.T) {
+			value, truncated := capFieldValue(tt.value)
+			s, ok := value.(string)
+			if !truncated || !ok {
+				t.Fatalf("capFieldValue = %T, %v; want a truncated string", value, truncated)
+			}
+			if len(s) > maxExtractLength || !utf8.ValidString(s) {
+				t.Errorf("value of %d bytes, valid UTF-8 %v", len(s), utf8.ValidString(s))
+			}
+		})
+	}
+
+	t.Run("regex_extract", func(t *testing.T) {
+		value, err := runFileOperation(fileOperation{Op: "regex_extract", Pattern: "€+"}, []byte(long))
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := value.(regexExtractResult)
+		if !result.Truncated || len(result.Matches) != 1 {
+			t.Fatalf("result = %d matches, truncated %v; want 1 truncated match", len(result.Matches), result.Truncated)
+		}
+		if m := result.Matches[0]; len(m) > maxExtractLength || !utf8.ValidString(m) {
+			t.Errorf("match of %d bytes, valid UTF-8 %v", len(m), utf8.ValidString(m))
+		}
+	})
+}
+
+func TestProcessFileReportLimit(t *testing.T) {
+	withConfig(t, defaultConfig())
+
+	// Three extractions of 80 truncated matches each, about 330 KB, leave
+	// room for only some of the field values after them
+	path := filepath.Join(t.TempDir(), "doc.json")
+	words := strings.Repeat(strings.Repeat("x", maxExtractLength+4)+" ", 80)
+	if err := os.WriteFile(path, []byte(`{"v":"`+words+`"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	task := Task{FilePath: path}
+	for i := 0; i < 3; i++ {
+		task.Operations = append(task.Operations, fileOperation{Op: "regex_extract", Pattern: "x+"})
+	}
+	for len(task.Operations) < maxFileOperations {
+		task.Operations = append(task.Operations, fileOperation{Op: "field", Format: "json", Field: "v"})
+	}
+
+	result, err := processFileHandler{}.Run(context.Background(), task)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	resp := result.(processFileResponse)
+	if !resp.Truncated {
+		t.Error("report not flagged as truncated")
+	}
+
+	reported, left := 0, 0
+	for _, r := range resp.Results[3:] {
+		if !r.Truncated {
+			t.Errorf("field result lost its truncated flag: %+v", r.Error)
+		}
+		if r.Value == nil {
+			left++
+		} else {
+			reported++
+		}
+	}
+	if reported == 0 || left == 0 {
+		t.Fatalf("%d field values reported and %d left out, want some of each", reported, left)
+	}
+}
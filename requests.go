@@ -1,32 +1,193 @@
-package main 
+package main
 
 import (
-	"net/http"
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
 )
 
-func AuthenticatedPostRequestWithPayload(url string, payload []byte, token string) ([]byte, error) {
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
-	if err != nil {
-		return nil, err
+const userAgent = "Tally-Beacon/1.0"
+
+// errResponseTooLarge is returned when a response body exceeds cfg.MaxResponseBytes
+var errResponseTooLarge = errors.New("response too large")
+
+// HTTPStatusError is returned for non-2xx responses from the scorekeeper.
+// Code and Message are taken from the JSON error body when there is one,
+// e.g. {"code": "invalid_key", "error": "key not recognised"}. Challenge
+// holds the WWW-Authenticate header of a 401.
+type HTTPStatusError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Body       []byte
+	RetryAfter time.Duration
+	Challenge  string
+}
+
+func (e *HTTPStatusError) Error() string {
+	msg := fmt.Sprintf("received status code %d", e.StatusCode)
+	if e.Code != "" {
+		msg += " (" + e.Code + ")"
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
 	}
+	return msg
+}
+
+// newHTTPStatusError builds an HTTPStatusError, parsing the body if it is JSON
+func newHTTPStatusError(statusCode int, body []byte) *HTTPStatusError {
+	e := &HTTPStatusError{StatusCode: statusCode, Body: body}
+
+	var parsed struct {
+		Code    string `json:"code"`
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &parsed) == nil {
+		e.Code = parsed.Code
+		e.Message = parsed.Error
+		if e.Message == "" {
+			e.Message = parsed.Message
+		}
+	}
+	return e
+}
+
+// Shared HTTP client used for every scorekeeper request, so that
+// connections are reused across calls
+var (
+	httpClient     *http.Client
+	httpClientOnce sync.Once
+)
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("User-Agent", "Tally-Beacon/1.0")
+// getHTTPClient returns the shared HTTP client, building it from the
+// configuration on first use
+func getHTTPClient() *http.Client {
+	httpClientOnce.Do(func() {
+		transport := &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   cfg.HTTPDialTimeout.Duration(),
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   cfg.HTTPTLSTimeout.Duration(),
+			ResponseHeaderTimeout: cfg.HTTPTimeout.Duration(),
+			MaxIdleConns:          16,
+			MaxIdleConnsPerHost:   cfg.Workers + 1,
+			IdleConnTimeout:       90 * time.Second,
+			TLSClientConfig:       newTLSConfig(),
+			ForceAttemptHTTP2:     true,
+		}
+		httpClient = &http.Client{
+			Transport:     transport,
+			Timeout:       cfg.HTTPTimeout.Duration(),
+			CheckRedirect: checkRedirect,
+		}
+	})
+	return httpClient
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// doRequest sends a request with the shared client and returns the response
+// body, read up to cfg.MaxResponseBytes, and headers. Non-2xx responses are
+// returned as an *HTTPStatusError. Requests carrying the beacon key are refused over
+// plain HTTP unless allow_insecure_http is set.
+func doRequest(req *http.Request) ([]byte, http.Header, error) {
+	if req.URL.Scheme != "https" && !cfg.AllowInsecureHTTP {
+		return nil, nil, errInsecureEndpoint
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	start := time.Now()
+	resp, err := getHTTPClient().Do(req)
 	if err != nil {
-		return nil, err
+		logger.Debug("Scorekeeper request failed", "method", req.Method, "endpoint", req.URL.String(), "duration", time.Since(start), "error", err)
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
+	logger.Debug("Scorekeeper request", "method", req.Method, "endpoint", req.URL.String(), "status", resp.StatusCode, "duration", time.Since(start))
 
-	responseData, err := io.ReadAll(resp.Body)
+	responseData, err := io.ReadAll(io.LimitReader(resp.Body, cfg.MaxResponseBytes+1))
 	if err != nil {
-		return nil, err
+		return nil, nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if int64(len(responseData)) > cfg.MaxResponseBytes {
+		return nil, nil, fmt.Errorf("%w: %s exceeds %d bytes", errResponseTooLarge, req.URL.Path, cfg.MaxResponseBytes)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		statusErr := newHTTPStatusError(resp.StatusCode, responseData)
+		statusErr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+		statusErr.Challenge = resp.Header.Get("WWW-Authenticate")
+		return nil, nil, statusErr
+	}
+	return responseData, resp.Header, nil
+}
+
+// httpStatusCode returns the status code carried by an *HTTPStatusError, or 0
+func httpStatusCode(err error) int {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode
+	}
+	return 0
+}
+
+// doAuthenticatedRequest sends a request authenticated with the beacon key.
+// In auto mode, a scorekeeper that rejects a signed request without offering
+// request signing is asked again with bearer auth, which is then used for
+// bearerFallbackPeriod. If the bearer request is refused as well, the key
+// rather than the signature was the problem and signing is kept. Once a
+// signed request has been accepted there is no fallback for the rest of the
+// process.
+func doAuthenticatedRequest(ctx context.Context, method, url string, body []byte, token string) ([]byte, http.Header, error) {
+	send := func() ([]byte, http.Header, error) {
+		req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		signed, err := authorizeRequest(req, body, token)
+		if err != nil {
+			return nil, nil, err
+		}
+		respBody, header, err := doRequest(req)
+		if signed && err == nil {
+			signedRequestAccepted.Store(true)
+		}
+		return respBody, header, err
 	}
 
-	return responseData, nil
-}
\ No newline at end of file
+	respBody, header, err := send()
+	if shouldFallBackToBearer(err) {
+		fallBackToBearer()
+		respBody, header, err = send()
+		if _, ok := unauthorized(err); ok {
+			logger.Warn("Scorekeeper refused bearer authentication too, keeping signed requests")
+			cancelBearerFallback()
+		}
+	}
+	return respBody, header, err
+}
+
+// AuthenticatedPostRequestWithPayload posts a JSON payload authenticated
+// with the beacon key
+func AuthenticatedPostRequestWithPayload(ctx context.Context, url string, payload []byte, token string) ([]byte, error) {
+	body, _, err := doAuthenticatedRequest(ctx, "POST", url, payload, token)
+	return body, err
+}
+
+// AuthenticatedGetRequest performs a GET request authenticated with the
+// beacon key and returns the response body and headers
+func AuthenticatedGetRequest(ctx context.Context, url string, token string) ([]byte, http.Header, error) {
+	return doAuthenticatedRequest(ctx, "GET", url, nil, token)
+}
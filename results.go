@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrorCode is a machine-readable reason for a task failure
+type ErrorCode string
+
+const (
+	ErrCodeNotExist        ErrorCode = "NOTEXIST"          // file does not exist
+	ErrCodeMaxSize         ErrorCode = "MAXSIZE"           // file exceeds the size limit
+	ErrCodeEmpty           ErrorCode = "EMPTY"             // file is empty
+	ErrCodePermission      ErrorCode = "PERMISSION"        // file cannot be accessed
+	ErrCodeSymlink         ErrorCode = "SYMLINK"           // file is a symlink
+	ErrCodeNotRegular      ErrorCode = "NOT_REGULAR"       // file is a FIFO, device, socket or directory
+	ErrCodeHardlink        ErrorCode = "HARDLINK"          // file has more than one hard link
+	ErrCodeOwner           ErrorCode = "OWNER"             // file is not owned by the expected user
+	ErrCodeTimeout         ErrorCode = "TIMEOUT"           // the task or reading its file took too long
+	ErrCodePolicyDenied    ErrorCode = "POLICY_DENIED"     // path not allowed by the local policy file
+	ErrCodeIO              ErrorCode = "IO"                // any other filesystem error
+	ErrCodeKeyRotation     ErrorCode = "KEY_ROTATION"      // a new key could not be staged
+	ErrCodeCertRotation    ErrorCode = "CERT_ROTATION"     // a new client key or CSR could not be created
+	ErrCodeUnknownTaskType ErrorCode = "UNKNOWN_TASK_TYPE" // no handler for the task type
+	ErrCodeInvalidTask     ErrorCode = "INVALID_TASK"      // task parameters failed validation
+	ErrCodeInternal        ErrorCode = "INTERNAL"          // unexpected beacon-side error
+)
+
+// Task result statuses
+const (
+	taskStatusSucceeded = "succeeded"
+	taskStatusFailed    = "failed"
+)
+
+// resultsEndpoint receives results that have no type-specific endpoint,
+// such as failures for task types this beacon does not know
+const resultsEndpoint = "results"
+
+// taskError is a task failure with a machine-readable code
+type taskError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *taskError) Error() string {
+	return fmt.Sprintf("[%s] - %s", e.Code, e.Message)
+}
+
+// newTaskError creates a taskError with a formatted message
+func newTaskError(code ErrorCode, format string, v ...interface{}) *taskError {
+	return &taskError{Code: code, Message: fmt.Sprintf(format, v...)}
+}
+
+// resultEnvelope wraps every task result submitted to the scorekeeper with
+// the task's identity, timing and outcome. Payload holds the type-specific
+// result and may be present on failures too.
+type resultEnvelope struct {
+	TaskID     string      `json:"task_id,omitempty"`
+	TaskType   string      `json:"task_type"`
+	BeaconID   string      `json:"beacon_id"`
+	StartedAt  time.Time   `json:"started_at"`
+	FinishedAt time.Time   `json:"finished_at"`
+	DurationMs int64       `json:"duration_ms"`
+	Status     string      `json:"status"`
+	ErrorCode  ErrorCode   `json:"error_code,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	Payload    interface{} `json:"payload,omitempty"`
+
+	result TaskResult
+}
+
+// runTask executes a task within its deadline and wraps the outcome in a
+// result envelope
+func runTask(ctx context.Context, task Task) *resultEnvelope {
+	env := &resultEnvelope{
+		TaskID:    task.ID,
+		TaskType:  task.TaskType,
+		BeaconID:  cfg.BeaconID,
+		StartedAt: time.Now().UTC(),
+	}
+
+	timeout := taskTimeout(task)
+	taskCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	result, err := executeTask(taskCtx, task)
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = newTaskError(ErrCodeTimeout, "task timed out after %s", timeout)
+	}
+
+	env.FinishedAt = time.Now().UTC()
+	env.DurationMs = env.FinishedAt.Sub(env.StartedAt).Milliseconds()
+	env.setResult(result)
+
+	if err == nil {
+		env.Status = taskStatusSucceeded
+		return env
+	}
+
+	env.Status = taskStatusFailed
+	var te *taskError
+	if errors.As(err, &te) {
+		env.ErrorCode = te.Code
+		env.Error = te.Message
+	} else {
+		env.ErrorCode = ErrCodeInternal
+		env.Error = err.Error()
+	}
+	return env
+}
+
+// taskTimeout returns how long a task may run: the timeout_seconds the
+// scorekeeper sent with it, or task_timeout
+func taskTimeout(task Task) time.Duration {
+	if task.TimeoutSeconds > 0 {
+		return time.Duration(task.TimeoutSeconds) * time.Second
+	}
+	return cfg.TaskTimeout.Duration()
+}
+
+// setResult attaches the type-specific result as the payload
+func (env *resultEnvelope) setResult(result TaskResult) {
+	env.result = result
+	if result != nil {
+		env.Payload = result
+	}
+}
+
+// endpoint returns the scorekeeper API path the envelope is submitted to
+func (env *resultEnvelope) endpoint() string {
+	if env.result != nil {
+		return env.result.Endpoint()
+	}
+	return resultsEndpoint
+}
+
+// acknowledged runs the result's follow-up work once the scorekeeper has
+// accepted the envelope with the given response; failed tasks have nothing
+// to follow up
+func (env *resultEnvelope) acknowledged(ctx context.Context, response []byte) error {
+	if env.Status != taskStatusSucceeded || env.result == nil {
+		return nil
+	}
+	if r, ok := env.result.(responseAcknowledger); ok {
+		return r.AcknowledgedWithResponse(ctx, response)
+	}
+	return env.result.Acknowledged(ctx)
+}
+
+// failed reports whether the task failed, and why
+func (env *resultEnvelope) failed() (string, bool) {
+	if env.Status == taskStatusSucceeded {
+		return "", false
+	}
+	return fmt.Sprintf("[%s] - %s", env.ErrorCode, env.Error), true
+}
+
+// resumeEnvelope rebuilds a successful envelope recorded in the outbox so
+// that it can be resubmitted. It reports false if the task has to run again.
+func resumeEnvelope(task Task, recorded json.RawMessage) (*resultEnvelope, bool) {
+	var stored struct {
+		resultEnvelope
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(recorded, &stored); err != nil || stored.Status != taskStatusSucceeded {
+		return nil, false
+	}
+
+	h, ok := lookupTaskHandler(task.TaskType)
+	if !ok {
+		return nil, false
+	}
+	r, ok := h.(resumableHandler)
+	if !ok {
+		return nil, false
+	}
+	result, ok := r.Resume(task, stored.Payload)
+	if !ok {
+		return nil, false
+	}
+
+	env := stored.resultEnvelope
+	env.setResult(result)
+	return &env, true
+}
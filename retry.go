@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// errCircuitOpen is returned instead of contacting the scorekeeper while the
+// circuit breaker is open
+var errCircuitOpen = errors.New("scorekeeper circuit breaker is open")
+
+// retryPolicy controls how often and how fast a failed request is retried
+type retryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// defaultRetryPolicy returns the configured policy used for the task fetch
+// and for result submission
+func defaultRetryPolicy() retryPolicy {
+	return retryPolicy{
+		MaxAttempts: cfg.RetryAttempts,
+		BaseDelay:   cfg.RetryBaseDelay.Duration(),
+		MaxDelay:    cfg.RetryMaxDelay.Duration(),
+	}
+}
+
+// backoff returns the delay before the given retry (1-based), doubling from
+// BaseDelay up to MaxDelay with jitter over the upper half of the range
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	d := p.BaseDelay << (attempt - 1)
+	if d > p.MaxDelay || d <= 0 {
+		d = p.MaxDelay
+	}
+	return d/2 + time.Duration(rand.Int64N(int64(d/2)+1))
+}
+
+// withRetry calls fn until it succeeds, fails permanently, runs out of
+// attempts or ctx is done, consulting the circuit breaker before every
+// attempt. A request cut short by ctx says nothing about the scorekeeper, so
+// it does not count against the breaker.
+func withRetry(ctx context.Context, name string, policy retryPolicy, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !breaker.allow() {
+			return errCircuitOpen
+		}
+
+		err := fn()
+		if ctx.Err() != nil {
+			return err
+		}
+		breaker.record(err)
+		if err == nil || !isRetryable(err) {
+			return err
+		}
+
+		delay := policy.backoff(attempt)
+		if retryAfter := retryAfterDelay(err); retryAfter > 0 {
+			if retryAfter > policy.MaxDelay {
+				// The scorekeeper asked for more time than a retry may wait,
+				// so back the whole daemon off instead
+				breaker.holdUntil(time.Now().Add(retryAfter))
+				return err
+			}
+			delay = max(delay, retryAfter)
+		}
+
+		// Give up early once this failure has opened the breaker
+		if state, _ := breaker.snapshot(); attempt >= policy.MaxAttempts || state == breakerOpen {
+			return err
+		}
+
+		logger.Warn("Request failed, retrying", "request", name, "attempt", attempt, "max_attempts", policy.MaxAttempts, "retry_in", delay.Round(time.Millisecond), "error", err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// isRetryable reports whether a request error is worth retrying: 408, 429
+// and 5xx responses, and network errors and timeouts. Anything else, such as
+// a certificate or pin mismatch, a refused redirect or a rejected task list,
+// fails the same way again.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests:
+			return true
+		}
+		return statusErr.StatusCode >= 500
+	}
+
+	// *url.Error is itself a net.Error, so look at what it wraps
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		if urlErr.Timeout() {
+			return true
+		}
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+// retryAfterDelay returns the delay requested by a Retry-After header on a
+// 429 or 503 response, or 0
+func retryAfterDelay(err error) time.Duration {
+	var statusErr *HTTPStatusError
+	if !errors.As(err, &statusErr) {
+		return 0
+	}
+	if statusErr.StatusCode != http.StatusTooManyRequests && statusErr.StatusCode != http.StatusServiceUnavailable {
+		return 0
+	}
+	return statusErr.RetryAfter
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+// Circuit breaker states
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// circuitBreaker stops the beacon from contacting the scorekeeper after
+// repeated server-side failures. Once open it rejects every request until
+// the cooldown expires, then lets requests through as probes: a success
+// closes it again, a failure reopens it with a doubled cooldown.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	state     string
+	failures  int
+	cooldown  time.Duration
+	openUntil time.Time
+}
+
+// Global circuit breaker instance shared by every scorekeeper request
+var breaker = &circuitBreaker{state: breakerClosed}
+
+// allow reports whether a request may be sent now
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != breakerOpen {
+		return true
+	}
+	if time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.state = breakerHalfOpen
+	logger.Info("Circuit breaker half-open, probing scorekeeper")
+	return true
+}
+
+// record updates the breaker with the outcome of a request. Only failures
+// that indicate the scorekeeper is unavailable count against it.
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil || !isRetryable(err) {
+		if b.state != breakerClosed {
+			logger.Info("Circuit breaker closed, scorekeeper is reachable again")
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		b.cooldown = 0
+		return
+	}
+
+	b.failures++
+	switch {
+	case b.state == breakerHalfOpen:
+		cooldown := b.cooldown * 2
+		if cooldown <= 0 {
+			cooldown = cfg.BreakerCooldown.Duration()
+		}
+		b.open(min(cooldown, cfg.BreakerMaxCooldown.Duration()), err)
+	case b.state == breakerClosed && b.failures >= cfg.BreakerThreshold:
+		b.open(cfg.BreakerCooldown.Duration(), err)
+	}
+}
+
+// holdUntil opens the breaker until t at the scorekeeper's request
+func (b *circuitBreaker) holdUntil(t time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if t.After(b.openUntil) {
+		b.state = breakerOpen
+		b.openUntil = t
+		logger.Warn("Scorekeeper asked to back off, pausing requests", "until", t)
+	}
+}
+
+// open trips the breaker for the given cooldown; the caller must hold b.mu
+func (b *circuitBreaker) open(cooldown time.Duration, cause error) {
+	b.state = breakerOpen
+	b.cooldown = cooldown
+	b.openUntil = time.Now().Add(cooldown)
+	logger.Error("Circuit breaker open, pausing requests", "failures", b.failures, "cooldown", cooldown, "error", cause)
+}
+
+// snapshot returns the breaker state and, if open, when it will next probe
+func (b *circuitBreaker) snapshot() (string, time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen {
+		return b.state, b.openUntil
+	}
+	return b.state, time.Time{}
+}
+
+// describeBreaker returns a human-readable breaker state for logs and status
+func describeBreaker(state string, openUntil time.Time) string {
+	if state == breakerOpen && !openUntil.IsZero() {
+		return fmt.Sprintf("%s until %s", state, openUntil.Format(time.RFC3339))
+	}
+	return state
+}
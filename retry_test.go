@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"syscall"
+	"testing"
+)
+
+func TestIsRetryable(t *testing.T) {
+	// requestError wraps err the way the HTTP client reports a failed request
+	requestError := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://scorekeeper.example/api/tasks", Err: err}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "500", err: &HTTPStatusError{StatusCode: 500}, want: true},
+		{name: "503", err: &HTTPStatusError{StatusCode: 503}, want: true},
+		{name: "408", err: &HTTPStatusError{StatusCode: 408}, want: true},
+		{name: "429", err: &HTTPStatusError{StatusCode: 429}, want: true},
+		{name: "400", err: &HTTPStatusError{StatusCode: 400}, want: false},
+		{name: "401", err: &HTTPStatusError{StatusCode: 401}, want: false},
+		{name: "connection refused", err: requestError(&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}), want: true},
+		{name: "connection reset", err: requestError(&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}), want: true},
+		{name: "connection closed", err: requestError(io.EOF), want: true},
+		{name: "request timeout", err: requestError(context.DeadlineExceeded), want: true},
+		{name: "response body cut short", err: fmt.Errorf("failed to read response body: %w", io.ErrUnexpectedEOF), want: true},
+		{name: "unknown authority", err: requestError(&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}), want: false},
+		{name: "hostname mismatch", err: requestError(&tls.CertificateVerificationError{Err: x509.HostnameError{Host: "other.example"}}), want: false},
+		{name: "pin mismatch", err: requestError(errPinMismatch), want: false},
+		{name: "redirect loop", err: requestError(errTooManyRedirects), want: false},
+		{name: "redirect to plain http", err: requestError(errInsecureEndpoint), want: false},
+		{name: "plain http endpoint", err: errInsecureEndpoint, want: false},
+		{name: "rejected task list", err: &taskListRejection{Reason: "stale"}, want: false},
+		{name: "response too large", err: fmt.Errorf("%w: /api/tasks exceeds 10 bytes", errResponseTooLarge), want: false},
+		{name: "circuit open", err: errCircuitOpen, want: false},
+		{name: "cancelled", err: requestError(context.Canceled), want: false},
+		{name: "invalid response", err: fmt.Errorf("failed to parse tasks: unexpected end of JSON input"), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Secret store backends
+const (
+	secretStoreFile          = "file"
+	secretStoreEncryptedFile = "encrypted_file"
+	secretStoreSystemd       = "systemd"
+	secretStoreEnv           = "env"
+	secretStoreKeyring       = "keyring"
+)
+
+// keySlot names one of the keys the beacon holds: the active key, the key
+// staged by an unfinished rotation and the key replaced by the last rotation
+type keySlot string
+
+const (
+	slotActive   keySlot = "active"
+	slotPending  keySlot = "pending"
+	slotPrevious keySlot = "previous"
+)
+
+var (
+	errSecretNotFound      = errors.New("secret not found")
+	errSecretStoreReadOnly = errors.New("secret store is read-only")
+)
+
+// SecretStore keeps the beacon API key. Get returns errSecretNotFound for an
+// empty slot; read-only stores return errSecretStoreReadOnly from Put and Delete.
+type SecretStore interface {
+	Name() string
+	Writable() bool
+	Get(slot keySlot) (string, error)
+	Put(slot keySlot, value string) error
+	Delete(slot keySlot) error
+}
+
+// fileBackedStore is implemented by stores that keep each slot in a file,
+// which the key file watcher can then monitor
+type fileBackedStore interface {
+	path(slot keySlot) string
+}
+
+// newSecretStore returns the store selected by the configuration. Backends
+// that depend on the environment report problems on first use, so that
+// commands which never touch the key still work.
+func newSecretStore(c *Config) (SecretStore, error) {
+	switch c.SecretStore {
+	case secretStoreFile, secretStoreEncryptedFile:
+		if c.KeyFile == "" {
+			return nil, fmt.Errorf("key_file is required for the %s secret store", c.SecretStore)
+		}
+		store := &fileStore{keyFile: c.KeyFile}
+		if c.SecretStore == secretStoreEncryptedFile {
+			if c.SecretKeyFile == "" {
+				return nil, fmt.Errorf("secret_key_file is required for the encrypted_file secret store")
+			}
+			store.encryptionKeyFile = c.SecretKeyFile
+		}
+		return store, nil
+	case secretStoreSystemd:
+		return systemdStore{name: secretName(c, "tally.key")}, nil
+	case secretStoreEnv:
+		return envStore{name: secretName(c, "TALLY_BEACON_KEY")}, nil
+	case secretStoreKeyring:
+		return newKeyringStore(secretName(c, "tally"))
+	default:
+		return nil, fmt.Errorf("secret_store must be file, encrypted_file, systemd, env or keyring, got %q", c.SecretStore)
+	}
+}
+
+// secretName returns the configured secret name or the backend's default
+func secretName(c *Config, def string) string {
+	if c.SecretName != "" {
+		return c.SecretName
+	}
+	return def
+}
+
+// secretStore returns the configured secret store
+func secretStore() SecretStore {
+	return cfg.secretStore
+}
+
+// fileStore keeps each slot in a file next to the key file:
+// <key_file>, <key_file>.pending and <key_file>.prev. With an encryption key
+// file the contents are sealed with AES-256-GCM.
+type fileStore struct {
+	keyFile           string
+	encryptionKeyFile string
+}
+
+// openKeyFile opens a key file for reading without following a symlink in
+// its place, and refuses anything but a regular file
+func openKeyFile(path string) (*os.File, os.FileInfo, error) {
+	// openNoFollow reports a missing file as a task error; check first so
+	// that callers can still tell a missing key from a bad one
+	if _, err := os.Lstat(path); err != nil {
+		return nil, nil, err
+	}
+	f, err := openNoFollow(path, os.O_RDONLY)
+	if err != nil {
+		return nil, nil, fmt.Errorf("refusing key file %s: %v", path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, nil, fmt.Errorf("refusing key file %s: not a regular file", path)
+	}
+	return f, info, nil
+}
+
+// readKeyFile reads a key file opened by openKeyFile
+func readKeyFile(path string) ([]byte, error) {
+	f, _, err := openKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// sealedPrefix marks an encrypted key file
+const sealedPrefix = "tally-sealed-v1:"
+
+func (s *fileStore) Name() string {
+	if s.encryptionKeyFile != "" {
+		return secretStoreEncryptedFile
+	}
+	return secretStoreFile
+}
+
+func (s *fileStore) Writable() bool {
+	return true
+}
+
+func (s *fileStore) path(slot keySlot) string {
+	switch slot {
+	case slotPending:
+		return pendingKeyPath(s.keyFile)
+	case slotPrevious:
+		return previousKeyPath(s.keyFile)
+	default:
+		return s.keyFile
+	}
+}
+
+func (s *fileStore) Get(slot keySlot) (string, error) {
+	data, err := readKeyFile(s.path(slot))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("%w: %s", errSecretNotFound, s.path(slot))
+	}
+	if err != nil {
+		return "", err
+	}
+	if s.encryptionKeyFile == "" {
+		return string(data), nil
+	}
+	if !strings.HasPrefix(string(data), sealedPrefix) {
+		return "", fmt.Errorf("%s is not encrypted", s.path(slot))
+	}
+	return s.open(slot, strings.TrimPrefix(strings.TrimSpace(string(data)), sealedPrefix))
+}
+
+func (s *fileStore) Put(slot keySlot, value string) error {
+	data := []byte(value)
+	if s.encryptionKeyFile != "" {
+		sealed, err := s.seal(slot, value)
+		if err != nil {
+			return err
+		}
+		data = []byte(sealedPrefix + sealed + "\n")
+	}
+	if err := os.MkdirAll(filepath.Dir(s.keyFile), 0700); err != nil {
+		return fmt.Errorf("failed to create key directory: %v", err)
+	}
+	return writeOwnedFile(s.path(slot), data, keyFileMode)
+}
+
+func (s *fileStore) Delete(slot keySlot) error {
+	err := os.Remove(s.path(slot))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// encryptPlaintext seals key files written before encryption was enabled
+func (s *fileStore) encryptPlaintext() {
+	if s.encryptionKeyFile == "" {
+		return
+	}
+	for _, slot := range []keySlot{slotActive, slotPending, slotPrevious} {
+		data, err := readKeyFile(s.path(slot))
+		if err != nil || strings.HasPrefix(string(data), sealedPrefix) {
+			continue
+		}
+		if err := s.Put(slot, string(data)); err != nil {
+			logger.Error("Failed to encrypt key file", "path", s.path(slot), "error", err)
+			continue
+		}
+		logger.Info("Encrypted plaintext key file", "path", s.path(slot))
+	}
+}
+
+// aead loads the encryption key: 32 bytes, raw or hex or base64 encoded
+func (s *fileStore) aead() (cipher.AEAD, error) {
+	data, err := os.ReadFile(s.encryptionKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret_key_file: %v", err)
+	}
+
+	key := data
+	if len(key) != 32 {
+		text := strings.TrimSpace(string(data))
+		if decoded, err := hex.DecodeString(text); err == nil {
+			key = decoded
+		} else if decoded, err := base64.StdEncoding.DecodeString(text); err == nil {
+			key = decoded
+		}
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("secret_key_file must hold a 32-byte key (raw, hex or base64)")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts a key. The slot is authenticated too, so a sealed key
+// cannot be moved into another slot unnoticed.
+func (s *fileStore) seal(slot keySlot, value string) (string, error) {
+	aead, err := s.aead()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(slot))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a key sealed by seal
+func (s *fileStore) open(slot keySlot, sealed string) (string, error) {
+	aead, err := s.aead()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < aead.NonceSize() {
+		return "", fmt.Errorf("%s is corrupt", s.path(slot))
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(slot))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt %s: wrong secret_key_file or the file was modified", s.path(slot))
+	}
+	return string(plain), nil
+}
+
+// systemdStore reads the key from a systemd credential
+// (LoadCredential=/LoadCredentialEncrypted= in the unit). It is read-only.
+type systemdStore struct {
+	name string
+}
+
+func (s systemdStore) Name() string {
+	return secretStoreSystemd
+}
+
+func (s systemdStore) Writable() bool {
+	return false
+}
+
+func (s systemdStore) Get(slot keySlot) (string, error) {
+	if slot != slotActive {
+		return "", errSecretNotFound
+	}
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return "", fmt.Errorf("CREDENTIALS_DIRECTORY is not set; is the beacon running under systemd with LoadCredential=%s?", s.name)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, s.name))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("%w: credential %s", errSecretNotFound, s.name)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (s systemdStore) Put(slot keySlot, value string) error {
+	return errSecretStoreReadOnly
+}
+
+func (s systemdStore) Delete(slot keySlot) error {
+	return errSecretStoreReadOnly
+}
+
+// envStore reads the key from an environment variable, for containers that
+// inject secrets that way. It is read-only.
+type envStore struct {
+	name string
+}
+
+func (s envStore) Name() string {
+	return secretStoreEnv
+}
+
+func (s envStore) Writable() bool {
+	return false
+}
+
+func (s envStore) Get(slot keySlot) (string, error) {
+	if slot != slotActive {
+		return "", errSecretNotFound
+	}
+	value := strings.TrimSpace(os.Getenv(s.name))
+	if value == "" {
+		return "", fmt.Errorf("%w: $%s is empty", errSecretNotFound, s.name)
+	}
+	return value, nil
+}
+
+func (s envStore) Put(slot keySlot, value string) error {
+	return errSecretStoreReadOnly
+}
+
+func (s envStore) Delete(slot keySlot) error {
+	return errSecretStoreReadOnly
+}
@@ -2,14 +2,18 @@ package main
 
 import (
 	"context"
+	"time"
 
 	"github.com/kardianos/service"
 )
 
 // program implements the service.Interface for cross-platform service management
 type program struct {
-	ctx    context.Context
-	cancel context.CancelFunc
+	ctx        context.Context
+	cancel     context.CancelFunc
+	work       context.Context
+	cancelWork context.CancelFunc
+	done       chan struct{}
 }
 
 // Start is called by the service manager when the service starts
@@ -21,23 +25,70 @@ func (p *program) Start(s service.Service) error {
 		return err
 	}
 
-	// Create a cancellable context for graceful shutdown
+	// Refuse to run alongside another copy of the beacon
+	if err := acquireInstanceLock(); err != nil {
+		logger.Error("Failed to start", "error", err)
+		return err
+	}
+
+	// Create cancellable contexts for graceful shutdown: ctx stops new work,
+	// work aborts the work in flight
 	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.work, p.cancelWork = context.WithCancel(context.Background())
+
+	// Fail the service if the daemon cannot run, rather than report it
+	// started and leave it doing nothing
+	if err := prepareDaemon(p.ctx); err != nil {
+		p.cancel()
+		p.cancelWork()
+		return err
+	}
 
 	// Start the daemon in a goroutine so Start() returns immediately
+	p.done = make(chan struct{})
 	go func() {
-		RunDaemon(p.ctx)
+		defer close(p.done)
+		RunDaemon(p.ctx, p.work)
 	}()
 
 	return nil
 }
 
+// cancelledWorkTimeout bounds how long Stop waits for cancelled work to
+// unwind, so that the daemon's cleanup runs before the process exits
+const cancelledWorkTimeout = 5 * time.Second
+
 // Stop is called by the service manager when the service stops
-// This triggers graceful shutdown of the daemon
+// No new task cycles or tasks are started; the cycle in progress may finish
+// and submit its results for up to shutdown_timeout, after which its
+// requests and tasks are cancelled
 func (p *program) Stop(s service.Service) error {
 	// Cancel the context, which triggers ctx.Done() in RunDaemon
 	if p.cancel != nil {
 		p.cancel()
 	}
+	if p.done == nil {
+		if p.cancelWork != nil {
+			p.cancelWork()
+		}
+		return nil
+	}
+
+	select {
+	case <-p.done:
+		logger.Info("Tally Beacon Service stopped")
+		p.cancelWork()
+		return nil
+	case <-time.After(cfg.ShutdownTimeout.Duration()):
+		logger.Warn("Work in progress did not finish in time, cancelling it", "shutdown_timeout", cfg.ShutdownTimeout.Duration())
+	}
+
+	p.cancelWork()
+	select {
+	case <-p.done:
+		logger.Info("Tally Beacon Service stopped")
+	case <-time.After(cancelledWorkTimeout):
+		logger.Error("Cancelled work did not finish in time, stopping anyway", "timeout", cancelledWorkTimeout)
+	}
 	return nil
 }
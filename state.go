@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// daemonStatus is the snapshot of daemon state written to the state
+// directory after every cycle, so that `tally status` can report it
+type daemonStatus struct {
+	PID                int       `json:"pid"`
+	StartedAt          time.Time `json:"started_at,omitempty"`
+	Paused             bool      `json:"paused,omitempty"`
+	LastCycle          time.Time `json:"last_cycle,omitempty"`
+	LastCycleError     string    `json:"last_cycle_error,omitempty"`
+	LastSuccess        time.Time `json:"last_success,omitempty"`
+	LastHeartbeat      time.Time `json:"last_heartbeat,omitempty"`
+	ConfiguredInterval string    `json:"configured_interval"`
+	ServerInterval     string    `json:"server_interval,omitempty"`
+	EffectiveInterval  string    `json:"effective_interval"`
+	Jitter             float64   `json:"jitter"`
+	NextPoll           time.Time `json:"next_poll"`
+	Breaker            string    `json:"breaker"`
+	BreakerOpenUntil   time.Time `json:"breaker_open_until,omitempty"`
+	OutboxDepth        int       `json:"outbox_depth"`
+}
+
+// ensureStateDir creates the state directory if it does not exist
+func ensureStateDir() error {
+	if err := os.MkdirAll(cfg.StateDir, 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+	if err := restrictStateDir(cfg.StateDir); err != nil {
+		return fmt.Errorf("failed to restrict access to the state directory: %v", err)
+	}
+	return nil
+}
+
+// statePath returns the path of a file inside the state directory
+func statePath(name string) string {
+	return filepath.Join(cfg.StateDir, name)
+}
+
+// lastDaemonStatus is the snapshot written after the latest cycle, served
+// live over the control socket
+var lastDaemonStatus struct {
+	mu     sync.Mutex
+	status daemonStatus
+}
+
+// setDaemonStatus records the latest status snapshot
+func setDaemonStatus(status daemonStatus) {
+	lastDaemonStatus.mu.Lock()
+	lastDaemonStatus.status = status
+	lastDaemonStatus.mu.Unlock()
+}
+
+// currentDaemonStatus returns the latest status snapshot
+func currentDaemonStatus() daemonStatus {
+	lastDaemonStatus.mu.Lock()
+	defer lastDaemonStatus.mu.Unlock()
+	return lastDaemonStatus.status
+}
+
+// writeDaemonStatus persists the daemon status snapshot
+func writeDaemonStatus(status daemonStatus) error {
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(statePath("status.json"), data, 0644)
+}
+
+// readDaemonStatus loads the last status snapshot written by the daemon
+func readDaemonStatus() (daemonStatus, error) {
+	var status daemonStatus
+
+	data, err := os.ReadFile(statePath("status.json"))
+	if err != nil {
+		return status, err
+	}
+	if err := json.Unmarshal(data, &status); err != nil {
+		return status, fmt.Errorf("failed to parse status file: %v", err)
+	}
+	return status, nil
+}
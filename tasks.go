@@ -1,84 +1,116 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 )
 
-// getTasks retrieves tasks from a file or remote source
-func getTasks() (Tasks, error) {
-	tasks, err := getTasksFromScoreKeeper()
+// getTasks retrieves tasks from a file or remote source, and the key the
+// key slots must be settled on, if any (see getTasksFromScoreKeeper)
+func getTasks(ctx context.Context) (Tasks, *slotKey, error) {
+	tasks, accepted, err := getTasksFromScoreKeeper(ctx)
 	if err != nil {
-		fmt.Println("Failed to get tasks:", err)
-		return Tasks{}, err
+		var rejection *taskListRejection
+		if errors.As(err, &rejection) {
+			reportEvent(ctx, "task_list_rejected", map[string]string{"reason": rejection.Reason})
+		}
+		return Tasks{}, nil, err
 	}
 	// tasks, err := getTasksFromFile("tasks.json")
 	// if err != nil {
-	// 	fmt.Println("Failed to get tasks:", err)
 	// 	return Tasks{}, err
 	// }
-	return tasks, nil
+	return tasks, accepted, nil
 }
 
 // getTasksFromFile reads and parses tasks from a JSON file
 func getTasksFromFile(filePath string) (Tasks, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
-		fmt.Println("Error opening file:", err)
-		return Tasks{}, err
+		return Tasks{}, fmt.Errorf("failed to open task file: %v", err)
 	}
 	defer file.Close()
 
 	bytes, err := ioutil.ReadAll(file)
 	if err != nil {
-		fmt.Println("Error reading file:", err)
-		return Tasks{}, err
+		return Tasks{}, fmt.Errorf("failed to read task file: %v", err)
 	}
 
 	var tasks Tasks
 	err = json.Unmarshal(bytes, &tasks)
 	if err != nil {
-		fmt.Println("Error unmarshalling JSON:", err)
-		return Tasks{}, err
+		return Tasks{}, fmt.Errorf("failed to parse task file: %v", err)
 	}
 
 	return tasks, nil
 }
 
-// getTasksFromScoreKeeper retrieves tasks from the scorekeeper API
-func getTasksFromScoreKeeper() (Tasks, error) {
-	tasksEndpoint := GetEndpointURL("tasks")
-
+// getTasksFromScoreKeeper retrieves tasks from the scorekeeper API. If the
+// active key is rejected it falls back to the keys of an unfinished rotation.
+// It runs under keyMu's read lock and so leaves the key slots alone: when
+// they have to change it returns the key the scorekeeper accepted, for
+// adoptKey to apply under the write lock.
+func getTasksFromScoreKeeper(ctx context.Context) (Tasks, *slotKey, error) {
 	key, err := getKey()
 	if err != nil {
-		return Tasks{}, fmt.Errorf("failed to get authentication key: %v", err)
+		return Tasks{}, nil, fmt.Errorf("failed to get authentication key: %v", err)
 	}
 
-	req, err := http.NewRequest("GET", tasksEndpoint, nil)
-	if err != nil {
-		return Tasks{}, fmt.Errorf("failed to create request: %v", err)
+	tasks, err := fetchTasks(ctx, key)
+	if httpStatusCode(err) != http.StatusUnauthorized {
+		if err != nil {
+			return Tasks{}, nil, err
+		}
+		if _, pendingErr := secretStore().Get(slotPending); pendingErr == nil {
+			return tasks, &slotKey{slot: slotActive, key: key}, nil
+		}
+		return tasks, nil, nil
 	}
 
-	req.Header.Set("Authorization", "Bearer "+key)
-	req.Header.Set("User-Agent", "Tally-Beacon/1.0")
+	for _, fallback := range fallbackKeys() {
+		fallbackTasks, fallbackErr := fetchTasks(ctx, fallback.key)
+		if httpStatusCode(fallbackErr) == http.StatusUnauthorized {
+			continue
+		}
+		if fallbackErr != nil {
+			return Tasks{}, nil, fallbackErr
+		}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return Tasks{}, fmt.Errorf("failed to make request: %v", err)
+		logger.Info("Scorekeeper accepted a fallback key, adopting it", "key", fallback.slot)
+		return fallbackTasks, &fallback, nil
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return Tasks{}, fmt.Errorf("received non-200 status code: %d", resp.StatusCode)
-	}
+	return Tasks{}, nil, err
+}
 
-	responseData, err := ioutil.ReadAll(resp.Body)
+// fetchTasks performs the task list request with the given key, retrying
+// transient failures. HTTP failures are returned as an *HTTPStatusError.
+func fetchTasks(ctx context.Context, key string) (Tasks, error) {
+	tasksEndpoint := GetEndpointURL("tasks")
+
+	var responseData []byte
+	var header http.Header
+	err := withRetry(ctx, "Task fetch", defaultRetryPolicy(), func() error {
+		var err error
+		responseData, header, err = AuthenticatedGetRequest(ctx, tasksEndpoint, key)
+		return err
+	})
 	if err != nil {
-		return Tasks{}, fmt.Errorf("failed to read response body: %v", err)
+		if httpStatusCode(err) != 0 || errors.Is(err, errCircuitOpen) {
+			return Tasks{}, err
+		}
+		return Tasks{}, fmt.Errorf("failed to make request: %v", err)
+	}
+
+	if err := verifyTaskList(responseData, header); err != nil {
+		return Tasks{}, err
 	}
 
 	var tasks Tasks
@@ -90,80 +122,93 @@ func getTasksFromScoreKeeper() (Tasks, error) {
 	return tasks, nil
 }
 
-// getTopTask returns the highest priority task (first in queue)
-func getTopTask(tasks Tasks) (Task, error) {
-	if len(tasks.Tasks) == 0 {
-		return Task{}, fmt.Errorf("no tasks found, we are all caught up!")
+// executeTask dispatches the task to the handler registered for its type
+func executeTask(ctx context.Context, task Task) (TaskResult, error) {
+	h, ok := lookupTaskHandler(task.TaskType)
+	if !ok {
+		return nil, newTaskError(ErrCodeUnknownTaskType, "unknown task type: %s (supported: %s)", task.TaskType, strings.Join(registeredTaskTypes(), ", "))
 	}
-	return tasks.Tasks[0], nil
-}
-
-// executeTask dispatches the task to the appropriate handler based on type
-func executeTask(task Task) (controlCheckResponse, keyRotationResponse, error) {
-	switch task.TaskType {
-	case "check_control":
-		fmt.Println("Executing check_control task")
-		resp, err := checkControl(task)
-		if err != nil {
-			return controlCheckResponse{}, keyRotationResponse{}, err
-		}
-		return resp, keyRotationResponse{}, nil
 
-	case "process_file":
-		fmt.Println("Executing process_file task on file:", task.FilePath)
-		// TODO: Implement process_file handler
+	if err := h.Validate(task); err != nil {
+		return nil, newTaskError(ErrCodeInvalidTask, "invalid %s task: %v", task.TaskType, err)
+	}
 
-	case "rotate_key":
-		fmt.Println("Executing rotate_key task")
-		resp, err := rotateKey(task)
-		if err != nil {
-			return controlCheckResponse{}, keyRotationResponse{}, err
-		}
-		return controlCheckResponse{}, resp, nil
+	if err := checkPathPolicy(task); err != nil {
+		return nil, err
 	}
 
-	return controlCheckResponse{}, keyRotationResponse{}, fmt.Errorf("unknown task type: %s", task.TaskType)
+	taskLogger(task).Debug("Executing task")
+	return h.Run(ctx, task)
 }
 
-func submitTaskResult(checkResponse controlCheckResponse, key string) error {
-	taskSubmissionEndpoint := GetEndpointURL("claim")
-
-	jsonControlCheckResponse, err := json.Marshal(checkResponse)
-	if err != nil {
-		LogError("Failure to marshal control check response: %v", err)
-		return err
+// skipCompletedTasks drops tasks the ledger shows were already completed
+// and tasks whose result is still waiting in the outbox
+func skipCompletedTasks(tasks []Task) []Task {
+	var pending map[string]bool
+	if resultOutbox != nil {
+		pending = resultOutbox.pendingTaskIDs()
+	}
+
+	remaining := make([]Task, 0, len(tasks))
+	for _, task := range tasks {
+		if task.ID != "" {
+			if taskCompleted(task) {
+				taskLogger(task).Info("Task was already completed, skipping")
+				continue
+			}
+			if pending[task.ID] {
+				taskLogger(task).Info("Task already ran, its result is waiting in the outbox")
+				continue
+			}
+		}
+		remaining = append(remaining, task)
 	}
+	return remaining
+}
 
-	_, err = AuthenticatedPostRequestWithPayload(taskSubmissionEndpoint, jsonControlCheckResponse, key)
-	if err != nil {
-		LogError("Failure to submit task result: %v", err)
-		return err
+// taskCompleted reports whether the ledger shows the task as completed
+func taskCompleted(task Task) bool {
+	if task.ID == "" || ledger == nil {
+		return false
 	}
+	entry, ok := ledger.lookup(task.ID)
+	return ok && entry.State == ledgerCompleted
+}
 
-	if err := clearControlFile(checkResponse.FilePath); err != nil {
-		LogError("Submitted check_control response but failed to clear control file %s: %v", checkResponse.FilePath, err)
-		return err
+// markTaskCompleted records in the ledger that the scorekeeper acknowledged a task
+func markTaskCompleted(task Task) {
+	if task.ID == "" || ledger == nil {
+		return
+	}
+	if err := ledger.markCompleted(task); err != nil {
+		taskLogger(task).Error("Failed to record task in ledger", "error", err)
 	}
-
-	LogInfo("Successfully submitted check_control response and cleared control file")
-	return nil
 }
 
-func submitKeyRotationResult(keyRotResponse keyRotationResponse, key string) error {
-	taskSubmissionEndpoint := GetEndpointURL("rotate_key")
+// submitResult posts a task's result envelope to its endpoint and returns
+// the scorekeeper's response
+func submitResult(ctx context.Context, task Task, env *resultEnvelope, key string) ([]byte, error) {
+	taskSubmissionEndpoint := GetEndpointURL(env.endpoint())
+	log := taskLogger(task).With("endpoint", taskSubmissionEndpoint)
 
-	jsonKeyRotationResponse, err := json.Marshal(keyRotResponse)
+	payload, err := json.Marshal(env)
 	if err != nil {
-		LogError("Failure to marshal key rotation response: %v", err)
-		return err
+		log.Error("Failed to marshal task result", "error", err)
+		return nil, err
 	}
 
-	_, err = AuthenticatedPostRequestWithPayload(taskSubmissionEndpoint, jsonKeyRotationResponse, key)
-	if err != nil {
-		LogError("Failure to submit key rotation result: %v", err)
+	start := time.Now()
+	var response []byte
+	err = withRetry(ctx, "Submitting "+task.TaskType+" result", defaultRetryPolicy(), func() error {
+		var err error
+		response, err = AuthenticatedPostRequestWithPayload(ctx, taskSubmissionEndpoint, payload, key)
 		return err
+	})
+	if err != nil {
+		log.Error("Failed to submit task result", "duration", time.Since(start), "error", err)
+		return nil, err
 	}
 
-	LogInfo("Successfully submitted rotate_key response")
-	return nil
+	log.Info("Submitted task result", "duration", time.Since(start))
+	return response, nil
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers carrying the scorekeeper's signature on a task list
+const (
+	taskSignatureHeader = "X-Tally-Signature"
+	taskTimestampHeader = "X-Tally-Timestamp"
+)
+
+// taskListRejection is returned for task lists that fail signature checks
+type taskListRejection struct {
+	Reason string
+}
+
+func (e *taskListRejection) Error() string {
+	return "rejected task list: " + e.Reason
+}
+
+// lastTaskListTime holds the timestamp of the newest accepted task list and
+// the signatures accepted with that timestamp, persisted so that replays are
+// also caught across restarts. Timestamps have a resolution of one second, so
+// several lists may legitimately carry the newest one.
+var lastTaskListTime struct {
+	mu         sync.Mutex
+	loaded     bool
+	unix       int64
+	signatures []string
+}
+
+// parseTaskSigningKey decodes the base64 Ed25519 public key from the config
+func parseTaskSigningKey(s string) (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("expected a base64 Ed25519 public key (%d bytes)", ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// taskSignatureMessage returns the bytes the scorekeeper signs:
+//
+//	tally-tasks-v1\n<unix timestamp>\n<beacon id>\n<body>
+func taskSignatureMessage(timestamp, beaconID string, body []byte) []byte {
+	msg := []byte("tally-tasks-v1\n" + timestamp + "\n" + beaconID + "\n")
+	return append(msg, body...)
+}
+
+// verifyTaskList checks the signature on a task list response. Lists must
+// be signed for this beacon, be no older than task_signature_max_age, not be
+// older than the last accepted list and not repeat a list already accepted.
+// Verification is skipped when no task_signing_key is configured.
+func verifyTaskList(body []byte, header http.Header) error {
+	if cfg.taskSigningKey == nil {
+		return nil
+	}
+
+	signature := header.Get(taskSignatureHeader)
+	timestamp := header.Get(taskTimestampHeader)
+	if signature == "" || timestamp == "" {
+		return &taskListRejection{Reason: "task list is not signed"}
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return &taskListRejection{Reason: "malformed signature"}
+	}
+	if !ed25519.Verify(cfg.taskSigningKey, taskSignatureMessage(timestamp, cfg.BeaconID, body), sig) {
+		return &taskListRejection{Reason: "invalid signature"}
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return &taskListRejection{Reason: fmt.Sprintf("malformed timestamp %q", timestamp)}
+	}
+	age := time.Since(time.Unix(unix, 0))
+	if age > cfg.TaskSignatureMaxAge.Duration() || -age > cfg.TaskSignatureMaxAge.Duration() {
+		return &taskListRejection{Reason: fmt.Sprintf("stale task list (signed %s, max age %s)", time.Unix(unix, 0).UTC().Format(time.RFC3339), cfg.TaskSignatureMaxAge)}
+	}
+
+	return acceptTaskListTime(unix, signature)
+}
+
+// acceptTaskListTime records a verified task list timestamp and signature,
+// rejecting lists older than the last one accepted and exact repeats of a
+// list accepted with the same timestamp. The state file holds the timestamp
+// on its first line and the signatures accepted with it on the following ones.
+func acceptTaskListTime(unix int64, signature string) error {
+	lastTaskListTime.mu.Lock()
+	defer lastTaskListTime.mu.Unlock()
+
+	path := statePath("task_list_timestamp")
+	if !lastTaskListTime.loaded {
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to read last task list timestamp: %v", err)
+		}
+		if err == nil {
+			lines := strings.Fields(string(data))
+			if len(lines) > 0 {
+				lastTaskListTime.unix, _ = strconv.ParseInt(lines[0], 10, 64)
+				lastTaskListTime.signatures = lines[1:]
+			}
+		}
+		lastTaskListTime.loaded = true
+	}
+
+	if unix < lastTaskListTime.unix {
+		return &taskListRejection{Reason: fmt.Sprintf("replayed task list (signed at %d, last accepted %d)", unix, lastTaskListTime.unix)}
+	}
+	signatures := []string{signature}
+	if unix == lastTaskListTime.unix {
+		for _, seen := range lastTaskListTime.signatures {
+			if seen == signature {
+				return &taskListRejection{Reason: fmt.Sprintf("replayed task list (signed at %d, already accepted)", unix)}
+			}
+		}
+		signatures = append(lastTaskListTime.signatures, signature)
+	}
+
+	data := strconv.FormatInt(unix, 10) + "\n" + strings.Join(signatures, "\n") + "\n"
+	if err := writeFileAtomic(path, []byte(data), 0600); err != nil {
+		return fmt.Errorf("failed to record task list timestamp: %v", err)
+	}
+	lastTaskListTime.unix = unix
+	lastTaskListTime.signatures = signatures
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedTaskList is a task list response as the scorekeeper would send it
+type signedTaskList struct {
+	body   string
+	header http.Header
+}
+
+// signTaskList signs body for beaconID at the given time
+func signTaskList(priv ed25519.PrivateKey, at time.Time, beaconID, body string) signedTaskList {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	sig := ed25519.Sign(priv, taskSignatureMessage(timestamp, beaconID, []byte(body)))
+	header := http.Header{}
+	header.Set(taskSignatureHeader, base64.StdEncoding.EncodeToString(sig))
+	header.Set(taskTimestampHeader, timestamp)
+	return signedTaskList{body: body, header: header}
+}
+
+// resetTaskListTime forgets the last accepted task list
+func resetTaskListTime(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		lastTaskListTime.mu.Lock()
+		lastTaskListTime.loaded = false
+		lastTaskListTime.unix = 0
+		lastTaskListTime.signatures = nil
+		lastTaskListTime.mu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestVerifyTaskList(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	body := `{"tasks":[]}`
+	valid := signTaskList(priv, now, "beacon-1", body)
+
+	tests := []struct {
+		name     string
+		accepted []signedTaskList // lists accepted before this one
+		list     signedTaskList
+		wantErr  string
+	}{
+		{name: "valid", list: valid},
+		{name: "unsigned", list: signedTaskList{body: body, header: http.Header{}}, wantErr: "not signed"},
+		{
+			name: "malformed signature",
+			list: signedTaskList{body: body, header: http.Header{
+				taskSignatureHeader: {"bm90IGEgc2lnbmF0dXJl"},
+				taskTimestampHeader: {strconv.FormatInt(now.Unix(), 10)},
+			}},
+			wantErr: "malformed signature",
+		},
+		{name: "wrong key", list: signTaskList(otherPriv, now, "beacon-1", body), wantErr: "invalid signature"},
+		{name: "other beacon", list: signTaskList(priv, now, "beacon-2", body), wantErr: "invalid signature"},
+		{
+			name:    "altered body",
+			list:    signedTaskList{body: `{"tasks":[{"id":"x"}]}`, header: valid.header},
+			wantErr: "invalid signature",
+		},
+		{name: "stale", list: signTaskList(priv, now.Add(-time.Hour), "beacon-1", body), wantErr: "stale"},
+		{name: "from the future", list: signTaskList(priv, now.Add(time.Hour), "beacon-1", body), wantErr: "stale"},
+		{
+			name:     "older than last accepted",
+			accepted: []signedTaskList{valid},
+			list:     signTaskList(priv, now.Add(-10*time.Second), "beacon-1", body),
+			wantErr:  "replayed",
+		},
+		{name: "exact repeat", accepted: []signedTaskList{valid}, list: valid, wantErr: "replayed"},
+		{
+			name:     "same second, different body",
+			accepted: []signedTaskList{valid},
+			list:     signTaskList(priv, now, "beacon-1", `{"tasks":[],"nonce":1}`),
+		},
+		{
+			name:     "newer than last accepted",
+			accepted: []signedTaskList{signTaskList(priv, now.Add(-10*time.Second), "beacon-1", body)},
+			list:     valid,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, &Config{
+				BeaconID:            "beacon-1",
+				StateDir:            t.TempDir(),
+				TaskSignatureMaxAge: Duration(5 * time.Minute),
+				taskSigningKey:      pub,
+			})
+			resetTaskListTime(t)
+
+			for _, list := range tt.accepted {
+				if err := verifyTaskList([]byte(list.body), list.header); err != nil {
+					t.Fatalf("accepting earlier list: %v", err)
+				}
+			}
+
+			err := verifyTaskList([]byte(tt.list.body), tt.list.header)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verifyTaskList: %v", err)
+				}
+				return
+			}
+			var rejection *taskListRejection
+			if !errors.As(err, &rejection) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("verifyTaskList error = %v, want a rejection containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyTaskListPersistsLastAccepted(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, &Config{
+		BeaconID:            "beacon-1",
+		StateDir:            t.TempDir(),
+		TaskSignatureMaxAge: Duration(5 * time.Minute),
+		taskSigningKey:      pub,
+	})
+	resetTaskListTime(t)
+
+	list := signTaskList(priv, time.Now(), "beacon-1", `{"tasks":[]}`)
+	if err := verifyTaskList([]byte(list.body), list.header); err != nil {
+		t.Fatalf("verifyTaskList: %v", err)
+	}
+
+	// A restart forgets the in-memory state but not the state file
+	resetTaskListTime(t)
+	if err := verifyTaskList([]byte(list.body), list.header); err == nil {
+		t.Fatal("replayed list accepted after a restart")
+	}
+}
+
+func TestVerifyTaskListWithoutKey(t *testing.T) {
+	withConfig(t, &Config{BeaconID: "beacon-1"})
+	if err := verifyTaskList([]byte(`{"tasks":[]}`), http.Header{}); err != nil {
+		t.Fatalf("unsigned list rejected without task_signing_key: %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// errInsecureEndpoint is returned instead of sending the beacon key over
+// plain HTTP when allow_insecure_http is not set
+var errInsecureEndpoint = errors.New("refusing to send the beacon key over plain http (use https or set allow_insecure_http)")
+
+// Errors that stop a connection or redirect; retrying does not change them
+var (
+	errPinMismatch      = errors.New("scorekeeper certificate does not match any configured pin")
+	errTooManyRedirects = errors.New("stopped after 10 redirects")
+)
+
+// tlsPin is one accepted scorekeeper key or certificate
+type tlsPin struct {
+	spki bool // hash of the SubjectPublicKeyInfo rather than the whole certificate
+	hash [sha256.Size]byte
+}
+
+// parseTLSPin parses a pin in one of two forms:
+//
+//	sha256//<base64>   SHA-256 of the public key (SPKI), as used by curl
+//	<hex>              SHA-256 fingerprint of the certificate, as printed by
+//	                   openssl x509 -fingerprint -sha256 (colons optional)
+func parseTLSPin(s string) (tlsPin, error) {
+	var pin tlsPin
+	var raw []byte
+	var err error
+
+	if encoded, ok := strings.CutPrefix(s, "sha256//"); ok {
+		pin.spki = true
+		raw, err = base64.StdEncoding.DecodeString(encoded)
+	} else {
+		raw, err = hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	}
+	if err != nil || len(raw) != sha256.Size {
+		return pin, fmt.Errorf("invalid pin %q: expected sha256//<base64 SPKI hash> or a hex SHA-256 certificate fingerprint", s)
+	}
+	copy(pin.hash[:], raw)
+	return pin, nil
+}
+
+// matches reports whether the certificate is the pinned one
+func (p tlsPin) matches(cert *x509.Certificate) bool {
+	if p.spki {
+		return sha256.Sum256(cert.RawSubjectPublicKeyInfo) == p.hash
+	}
+	return sha256.Sum256(cert.Raw) == p.hash
+}
+
+// loadCABundle reads a PEM file of CA certificates to trust instead of the
+// system roots
+func loadCABundle(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", path)
+	}
+	return pool, nil
+}
+
+// newTLSConfig builds the client TLS configuration for the scorekeeper. The
+// certificate chain is always verified, against tls_ca_file if set; with
+// tls_pins the verified chain must also contain a pinned key or certificate.
+// With tls_client_cert_file the beacon also authenticates with a client
+// certificate.
+func newTLSConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    cfg.tlsRootCAs,
+	}
+	if len(cfg.tlsPins) > 0 {
+		config.VerifyConnection = verifyPinnedConnection
+	}
+	if cfg.TLSClientCertFile != "" {
+		config.GetClientCertificate = loadClientCertificate
+	}
+	return config
+}
+
+// loadClientCertificate reads the client certificate for every handshake,
+// so that a certificate installed by rotate_cert is used without a restart.
+// Until the first certificate is installed no certificate is presented.
+func loadClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	clientCertMu.RLock()
+	defer clientCertMu.RUnlock()
+
+	cert, err := tls.LoadX509KeyPair(cfg.TLSClientCertFile, cfg.TLSClientKeyFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &tls.Certificate{}, nil
+		}
+		return nil, fmt.Errorf("failed to load client certificate: %v", err)
+	}
+	return &cert, nil
+}
+
+// verifyPinnedConnection rejects connections whose verified chains contain
+// none of the configured pins
+func verifyPinnedConnection(cs tls.ConnectionState) error {
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			for _, pin := range cfg.tlsPins {
+				if pin.matches(cert) {
+					return nil
+				}
+			}
+		}
+	}
+	return errPinMismatch
+}
+
+// checkRedirect stops redirects that would downgrade to plain HTTP
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errTooManyRedirects
+	}
+	if req.URL.Scheme != "https" && !cfg.AllowInsecureHTTP {
+		return errInsecureEndpoint
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseTLSPin(t *testing.T) {
+	hash := bytes.Repeat([]byte{0xab}, 32)
+
+	tests := []struct {
+		name     string
+		pin      string
+		wantSPKI bool
+		wantErr  bool
+	}{
+		{name: "spki base64", pin: "sha256//q6urq6urq6urq6urq6urq6urq6urq6urq6urq6urq6s=", wantSPKI: true},
+		{name: "hex fingerprint", pin: "abababababababababababababababababababababababababababababababab"},
+		{name: "hex fingerprint with colons", pin: "AB:AB:AB:AB:AB:AB:AB:AB:AB:AB:AB:AB:AB:AB:AB:AB:AB:AB:AB:AB:AB:AB:AB:AB:AB:AB:AB:AB:AB:AB:AB:AB"},
+		{name: "empty", pin: "", wantErr: true},
+		{name: "spki not base64", pin: "sha256//not base64!", wantErr: true},
+		{name: "spki wrong length", pin: "sha256//q6urqw==", wantErr: true},
+		{name: "hex wrong length", pin: "abab", wantErr: true},
+		{name: "not hex", pin: "zzabababababababababababababababababababababababababababababab", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pin, err := parseTLSPin(tt.pin)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseTLSPin(%q) succeeded, want error", tt.pin)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTLSPin(%q): %v", tt.pin, err)
+			}
+			if pin.spki != tt.wantSPKI {
+				t.Errorf("spki = %v, want %v", pin.spki, tt.wantSPKI)
+			}
+			if !bytes.Equal(pin.hash[:], hash) {
+				t.Errorf("hash = %x, want %x", pin.hash, hash)
+			}
+		})
+	}
+}
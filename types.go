@@ -3,26 +3,51 @@ package main
 // Tasks represents the root structure containing a list of tasks
 type Tasks struct {
 	Tasks []Task `json:"tasks"`
+
+	// NextPollSeconds lets the scorekeeper steer when the beacon polls next
+	NextPollSeconds int `json:"next_poll_seconds,omitempty"`
 }
 
-// Task represents a single task with its type and optional file path
+// Task represents a single task with its type and optional file path.
+// ID is assigned by the scorekeeper and is echoed back in the result.
 type Task struct {
-	TaskType string `json:"type"`
-	FilePath string `json:"file_path,omitempty"`
+	ID         string          `json:"id,omitempty"`
+	TaskType   string          `json:"type"`
+	FilePath   string          `json:"file_path,omitempty"`
+	Operations []fileOperation `json:"operations,omitempty"`
+
+	// TimeoutSeconds overrides task_timeout for this task
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+}
+
+// fileOperation is one analysis step of a process_file task
+type fileOperation struct {
+	Op      string `json:"op"`
+	Pattern string `json:"pattern,omitempty"`
+	Format  string `json:"format,omitempty"`
+	Field   string `json:"field,omitempty"`
 }
 
 // controlCheckResponse contains the result of a control file check
 type controlCheckResponse struct {
-	Success     bool   `json:"success"`
 	FilePath    string `json:"file_path"`
 	FileExists  bool   `json:"file_exists"`
-	FileContent string `json:"file_content"`
-	AccessError string `json:"access_error"`
+	FileContent string `json:"file_content,omitempty"`
 }
 
 // keyRotationResponse contains the result of a key rotation operation
 type keyRotationResponse struct {
-	Success       bool   `json:"success"`
-	NewKey        string `json:"new_key"`
-	RotationError string `json:"rotation_error"`
+	NewKey string `json:"new_key"`
+}
+
+// certRotationResponse contains the certificate signing request of a
+// certificate rotation
+type certRotationResponse struct {
+	CSR string `json:"csr"`
+}
+
+// certRotationAck is the scorekeeper's response to a certificate signing
+// request: the signed certificate, optionally followed by intermediates
+type certRotationAck struct {
+	Certificate string `json:"certificate"`
 }